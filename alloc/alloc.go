@@ -1,15 +1,38 @@
 package alloc
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
 	"sync"
+	"sync/atomic"
 )
 
+// SHARDBITS is the number of numbers in each independently locked shard of
+// the bitmap (a multiple of SUMMARYBITS, so each chunk is in one shard).
+const SHARDBITS uint64 = 8 * SUMMARYBITS
+
 // Allocator uses a bit map to allocate and free numbers. Bit 0
 // corresponds to number 0, bit 1 to 1, and so on.
+//
+// Numbers can be allocated one at a time or as contiguous extents (see
+// AllocExtent). To keep related numbers together, AllocNear allocates close to
+// a hint, and AllocGroup allocates within an allocation group.
+//
+// The bitmap is divided into shards of SHARDBITS numbers, each with its own
+// lock, so that allocating and freeing single numbers in different shards
+// proceeds in parallel. Operations that search across shards (AllocExtent and
+// AllocNear) lock shards in order as the search reaches them, and release
+// those that can no longer hold the result. The number of free numbers is tracked as
+// numbers are allocated and freed, so NumFree takes no locks.
 type Alloc struct {
-	mu     *sync.Mutex
-	next   uint64 // first number to try
+	shards []*sync.Mutex // shard i protects numbers [i*SHARDBITS, (i+1)*SHARDBITS)
+	next   uint64        // last number allocated by AllocNum (accessed atomically)
+	nfree  uint64        // number of free numbers (accessed atomically)
 	bitmap []byte
+	sums   []summary // summary of each chunk of the bitmap
+	groups []group   // allocation groups, if any
 }
 
 // MkAlloc initializes with a bitmap.
@@ -17,19 +40,83 @@ type Alloc struct {
 // 0 bits correspond to free numbers and 1 bits correspond to in-use numbers.
 func MkAlloc(bitmap []byte) *Alloc {
 	a := &Alloc{
-		mu:     new(sync.Mutex),
 		next:   0,
 		bitmap: bitmap,
 	}
+	nshards := (a.numBits() + SHARDBITS - 1) / SHARDBITS
+	for i := uint64(0); i < nshards; i++ {
+		a.shards = append(a.shards, new(sync.Mutex))
+	}
+	a.nfree = a.numBits() - countUsed(bitmap)
+	a.initSummaries()
 	return a
 }
 
+// countUsed counts the 1 bits in bitmap, eight bytes at a time
+func countUsed(bitmap []byte) uint64 {
+	var count uint64
+	var i = 0
+	for ; i+8 <= len(bitmap); i += 8 {
+		count += uint64(bits.OnesCount64(binary.LittleEndian.Uint64(bitmap[i:])))
+	}
+	for ; i < len(bitmap); i++ {
+		count += popCnt(bitmap[i])
+	}
+	return count
+}
+
+func (a *Alloc) shardOf(num uint64) uint64 {
+	return num / SHARDBITS
+}
+
+// lockRange locks the shards containing [lo, hi), in order.
+func (a *Alloc) lockRange(lo uint64, hi uint64) {
+	if lo >= hi {
+		return
+	}
+	for s := a.shardOf(lo); s <= a.shardOf(hi-1); s++ {
+		a.shards[s].Lock()
+	}
+}
+
+func (a *Alloc) unlockRange(lo uint64, hi uint64) {
+	if lo >= hi {
+		return
+	}
+	for s := a.shardOf(lo); s <= a.shardOf(hi-1); s++ {
+		a.shards[s].Unlock()
+	}
+}
+
+// setBit marks num used or free, keeping the free counts of the allocator and
+// of num's chunk up to date
+//
+// Assumes caller holds the lock for num's shard.
+func (a *Alloc) setBit(num uint64, used bool) {
+	byte := num / 8
+	bit := num % 8
+	wasFree := a.bitmap[byte]&(1<<bit) == 0
+	if wasFree != used {
+		return
+	}
+	s := &a.sums[num/SUMMARYBITS]
+	s.stale = true
+	if used {
+		a.bitmap[byte] = a.bitmap[byte] | (1 << bit)
+		atomic.AddUint64(&a.nfree, ^uint64(0))
+		s.free--
+	} else {
+		a.bitmap[byte] = a.bitmap[byte] & ^(1 << bit)
+		atomic.AddUint64(&a.nfree, 1)
+		s.free++
+	}
+}
+
 func (a *Alloc) MarkUsed(bn uint64) {
-	a.mu.Lock()
-	byte := bn / 8
-	bit := bn % 8
-	a.bitmap[byte] = a.bitmap[byte] | (1 << bit)
-	a.mu.Unlock()
+	s := a.shards[a.shardOf(bn)]
+	s.Lock()
+	a.setBit(bn, true)
+	s.Unlock()
 }
 
 // MkMaxAlloc initializes an allocator to be fully free with a range of (0,
@@ -46,45 +133,61 @@ func MkMaxAlloc(max uint64) *Alloc {
 	return a
 }
 
-func (a *Alloc) incNext() uint64 {
-	a.next = a.next + 1
-	if a.next >= uint64(len(a.bitmap)*8) {
-		a.next = 0
+// allocIn allocates the first free number in [lo, hi), which must be within
+// one shard
+func (a *Alloc) allocIn(lo uint64, hi uint64) (uint64, bool) {
+	if lo >= hi {
+		return 0, false
 	}
-	return a.next
+	s := a.shards[a.shardOf(lo)]
+	s.Lock()
+	num, ok := a.nextFree(lo, hi)
+	if ok {
+		a.setBit(num, true)
+	}
+	s.Unlock()
+	return num, ok
 }
 
 // Returns a free number in the bitmap
+//
+// Searches from the number after the last allocation, one shard at a time,
+// wrapping around to the beginning.
 func (a *Alloc) allocBit() uint64 {
-	var num uint64
-	a.mu.Lock()
-	num = a.incNext()
-	start := num
-	for {
-		bit := num % 8
-		byte := num / 8
-		// util.DPrintf(10, "allocBit: s %d num %d\n", start, num)
-		if a.bitmap[byte]&(1<<bit) == 0 {
-			a.bitmap[byte] = a.bitmap[byte] | (1 << bit)
-			break
+	nbits := a.numBits()
+	if nbits == 0 {
+		return 0
+	}
+	start := (atomic.LoadUint64(&a.next) + 1) % nbits
+	startShard := a.shardOf(start)
+	nshards := uint64(len(a.shards))
+	for i := uint64(0); i <= nshards; i++ {
+		sh := (startShard + i) % nshards
+		var lo = sh * SHARDBITS
+		var hi = lo + SHARDBITS
+		if hi > nbits {
+			hi = nbits
 		}
-		num = a.incNext()
-		if num == start { // looped around?
-			num = 0
-			break
+		if i == 0 {
+			lo = start
+		} else if i == nshards {
+			// back where we started, before start
+			hi = start
+		}
+		num, ok := a.allocIn(lo, hi)
+		if ok {
+			atomic.StoreUint64(&a.next, num)
+			return num
 		}
-		continue
 	}
-	a.mu.Unlock()
-	return num
+	return 0
 }
 
 func (a *Alloc) freeBit(bn uint64) {
-	a.mu.Lock()
-	byte := bn / 8
-	bit := bn % 8
-	a.bitmap[byte] = a.bitmap[byte] & ^(1 << bit)
-	a.mu.Unlock()
+	s := a.shards[a.shardOf(bn)]
+	s.Lock()
+	a.setBit(bn, false)
+	s.Unlock()
 }
 
 func (a *Alloc) AllocNum() uint64 {
@@ -92,30 +195,36 @@ func (a *Alloc) AllocNum() uint64 {
 	return num
 }
 
+// ErrInvalidNum is returned for freeing a number that the allocator never
+// hands out: 0 (which is reserved) or a number past the end of the bitmap.
+var ErrInvalidNum = errors.New("alloc: invalid number")
+
+// FreeNum frees num, which must have been allocated.
+//
+// Panics if num is invalid (see FreeNumErr).
 func (a *Alloc) FreeNum(num uint64) {
-	if num == 0 {
-		panic("FreeNum")
+	err := a.FreeNumErr(num)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// FreeNumErr is like FreeNum, but returns an error wrapping ErrInvalidNum
+// rather than panicking if num is 0 or out of range.
+func (a *Alloc) FreeNumErr(num uint64) error {
+	if num == 0 || num >= a.numBits() {
+		return fmt.Errorf("%w: %d (bitmap has %d numbers)", ErrInvalidNum,
+			num, a.numBits())
 	}
 	a.freeBit(num)
+	return nil
 }
 
 func popCnt(b byte) uint64 {
-	var count uint64
-	var x = b
-	for i := uint64(0); i < 8; i++ {
-		count += uint64(x & 1)
-		x = x >> 1
-	}
-	return count
+	return uint64(bits.OnesCount8(b))
 }
 
+// NumFree returns the number of free numbers, without locking the bitmap.
 func (a *Alloc) NumFree() uint64 {
-	a.mu.Lock()
-	total := 8 * uint64(len(a.bitmap))
-	var count uint64
-	for _, b := range a.bitmap {
-		count += popCnt(b)
-	}
-	a.mu.Unlock()
-	return total - count
+	return atomic.LoadUint64(&a.nfree)
 }
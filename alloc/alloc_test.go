@@ -1,6 +1,7 @@
 package alloc
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,3 +35,307 @@ func TestAlloc(t *testing.T) {
 	a.FreeNum(n2)
 	assert.Equal(max-2, a.NumFree(), "should have freed")
 }
+
+func TestAllocExtent(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(4096)
+
+	start, n := a.AllocExtent(10, 100)
+	assert.Equal(uint64(1), start, "first fit after reserved 0")
+	assert.Equal(uint64(100), n)
+	assert.Equal(uint64(4096-101), a.NumFree())
+
+	// a run that crosses chunk boundaries
+	start, n = a.AllocExtent(1000, 1000)
+	assert.Equal(uint64(101), start)
+	assert.Equal(uint64(1000), n)
+
+	a.FreeExtent(50, 20)
+	start, n = a.AllocExtent(10, 15)
+	assert.Equal(uint64(50), start, "should reuse the freed hole")
+	assert.Equal(uint64(15), n)
+
+	// only 5 free numbers remain in the hole, and the rest of the bitmap has
+	// a long run
+	start, n = a.AllocExtent(3000, 3000)
+	assert.Equal(uint64(0), n, "no run of 3000 free numbers")
+	start, n = a.AllocExtent(5, 3000)
+	assert.Equal(uint64(1101), start, "should fall back to the longest run")
+	assert.Equal(uint64(4096-1101), n)
+	start, n = a.AllocExtent(5, 10)
+	assert.Equal(uint64(65), start)
+	assert.Equal(uint64(5), n)
+	assert.Equal(uint64(0), a.NumFree())
+}
+
+func TestAllocExtentAcrossShards(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(4 * SHARDBITS)
+	for num := uint64(1); num < a.numBits(); num++ {
+		if !(SHARDBITS-10 <= num && num < SHARDBITS+10) &&
+			!(3*SHARDBITS <= num && num < 3*SHARDBITS+5) {
+			a.MarkUsed(num)
+		}
+	}
+	start, n := a.AllocExtent(20, 20)
+	assert.Equal(SHARDBITS-10, start, "run spanning two shards")
+	assert.Equal(uint64(20), n)
+	start, n = a.AllocExtent(1, 10)
+	assert.Equal(3*SHARDBITS, start, "should fall back to the longest run")
+	assert.Equal(uint64(5), n)
+	checkSummaries(t, a)
+}
+
+// checkSummaries checks the chunk summaries against the bitmap
+func checkSummaries(t *testing.T, a *Alloc) {
+	for c := range a.sums {
+		expected := a.summarize(uint64(c))
+		assert.Equal(t, expected.free, a.sums[c].free, "free count of chunk %d", c)
+		assert.Equal(t, expected, a.runSummary(uint64(c)), "chunk %d", c)
+	}
+}
+
+// naiveRun finds the first run of n free numbers by scanning the whole bitmap
+func naiveRun(a *Alloc, n uint64) (uint64, bool) {
+	var run uint64
+	for num := uint64(0); num < a.numBits(); num++ {
+		if a.isFree(num) {
+			run++
+			if run == n {
+				return num + 1 - n, true
+			}
+		} else {
+			run = 0
+		}
+	}
+	return 0, false
+}
+
+func TestExtentRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	a := MkMaxAlloc(8 * 600)
+	type extent struct{ start, n uint64 }
+	var allocated []extent
+	for i := 0; i < 2000; i++ {
+		if len(allocated) > 0 && rng.Intn(3) == 0 {
+			j := rng.Intn(len(allocated))
+			e := allocated[j]
+			allocated = append(allocated[:j], allocated[j+1:]...)
+			a.FreeExtent(e.start, e.n)
+		} else {
+			n := 1 + uint64(rng.Intn(700))
+			expected, ok := naiveRun(a, n)
+			start, got := a.AllocExtent(n, n)
+			if ok {
+				assert.Equal(t, expected, start, "first fit for %d", n)
+				assert.Equal(t, n, got)
+				allocated = append(allocated, extent{start, n})
+			} else {
+				assert.Equal(t, uint64(0), got)
+			}
+		}
+	}
+	checkSummaries(t, a)
+}
+
+// naiveNearest finds the free number closest to hint by scanning the bitmap
+func naiveNearest(a *Alloc, hint uint64) (uint64, bool) {
+	var best uint64
+	var found bool
+	for num := uint64(0); num < a.numBits(); num++ {
+		if a.isFree(num) && (!found || distance(num, hint) < distance(best, hint)) {
+			best = num
+			found = true
+		}
+	}
+	return best, found
+}
+
+func TestAllocNear(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(4096)
+	assert.Equal(uint64(2000), a.AllocNear(2000))
+	assert.Equal(uint64(1999), a.AllocNear(2000), "lower neighbor on a tie")
+	assert.Equal(uint64(2001), a.AllocNear(2000))
+	assert.Equal(uint64(4095), a.AllocNear(10000), "hint past the end")
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		hint := uint64(rng.Intn(4096))
+		expected, ok := naiveNearest(a, hint)
+		num := a.AllocNear(hint)
+		if !ok {
+			assert.Equal(uint64(0), num)
+			break
+		}
+		assert.Equal(expected, num, "nearest to %d", hint)
+	}
+	checkSummaries(t, a)
+}
+
+func TestAllocNearAcrossShards(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(4 * SHARDBITS)
+	rng := rand.New(rand.NewSource(1))
+	for num := uint64(1); num < a.numBits(); num++ {
+		if rng.Intn(1000) != 0 {
+			a.MarkUsed(num)
+		}
+	}
+	for {
+		hint := uint64(rng.Intn(int(a.numBits())))
+		expected, ok := naiveNearest(a, hint)
+		num := a.AllocNear(hint)
+		if !ok {
+			assert.Equal(uint64(0), num)
+			break
+		}
+		assert.Equal(expected, num, "nearest to %d", hint)
+	}
+	checkSummaries(t, a)
+}
+
+func TestAllocGroup(t *testing.T) {
+	assert := assert.New(t)
+	a := MkAllocGroups(make([]byte, 1024/8), 4)
+	a.MarkUsed(0)
+	assert.Equal(uint64(4), a.NumGroups())
+	assert.Equal(uint64(2), a.GroupOf(600))
+
+	assert.Equal(uint64(512), a.AllocGroup(2))
+	assert.Equal(uint64(513), a.AllocGroup(2))
+	assert.Equal(uint64(1), a.AllocGroup(0))
+	for i := 0; i < 254; i++ {
+		assert.Equal(uint64(2), a.GroupOf(a.AllocGroup(2)))
+	}
+	// group 2 is full, so allocate nearby
+	assert.Equal(uint64(511), a.AllocGroup(2))
+
+	a.FreeNum(600)
+	assert.Equal(uint64(600), a.AllocGroup(2), "cursor should wrap around")
+}
+
+func TestCountUsed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	bitmap := make([]byte, 1003)
+	rng.Read(bitmap)
+	var expected uint64
+	for _, b := range bitmap {
+		for i := 0; i < 8; i++ {
+			expected += uint64(b>>i) & 1
+		}
+	}
+	assert.Equal(t, expected, countUsed(bitmap))
+	assert.Equal(t, 8*uint64(len(bitmap))-expected, MkAlloc(bitmap).NumFree())
+}
+
+func TestConcurrentAlloc(t *testing.T) {
+	const max = 8 * SHARDBITS
+	a := MkMaxAlloc(max)
+	const nthreads = 8
+	const perThread = 1000
+	results := make(chan []uint64)
+	for i := 0; i < nthreads; i++ {
+		go func() {
+			var nums []uint64
+			for j := 0; j < perThread; j++ {
+				nums = append(nums, a.AllocNum())
+				if j%3 == 0 {
+					a.FreeNum(nums[len(nums)-1])
+					nums = nums[:len(nums)-1]
+				}
+			}
+			results <- nums
+		}()
+	}
+	seen := make(map[uint64]bool)
+	for i := 0; i < nthreads; i++ {
+		for _, n := range <-results {
+			assert.NotEqual(t, uint64(0), n)
+			assert.False(t, seen[n], "%d allocated twice", n)
+			seen[n] = true
+		}
+	}
+	assert.Equal(t, max-1-uint64(len(seen)), a.NumFree())
+	assert.Equal(t, a.NumFree(), a.numBits()-countUsed(a.bitmap))
+	checkSummaries(t, a)
+}
+
+func TestConcurrentSearch(t *testing.T) {
+	const max = 4 * SHARDBITS
+	a := MkMaxAlloc(max)
+	const nthreads = 8
+	results := make(chan []uint64)
+	for i := 0; i < nthreads; i++ {
+		i := i
+		go func() {
+			rng := rand.New(rand.NewSource(int64(i)))
+			var nums []uint64
+			for j := 0; j < 200; j++ {
+				switch rng.Intn(3) {
+				case 0:
+					if num := a.AllocNear(uint64(rng.Int63n(int64(max)))); num != 0 {
+						nums = append(nums, num)
+					}
+				case 1:
+					start, n := a.AllocExtent(1, 1+uint64(rng.Intn(50)))
+					for num := start; num < start+n; num++ {
+						nums = append(nums, num)
+					}
+				case 2:
+					if num := a.AllocNum(); num != 0 {
+						nums = append(nums, num)
+					}
+				}
+			}
+			results <- nums
+		}()
+	}
+	seen := make(map[uint64]bool)
+	for i := 0; i < nthreads; i++ {
+		for _, n := range <-results {
+			assert.False(t, seen[n], "%d allocated twice", n)
+			seen[n] = true
+		}
+	}
+	assert.Equal(t, max-1-uint64(len(seen)), a.NumFree())
+	checkSummaries(t, a)
+}
+
+func TestAllocFull(t *testing.T) {
+	a := MkMaxAlloc(2 * SHARDBITS)
+	for i := uint64(1); i < 2*SHARDBITS; i++ {
+		assert.NotEqual(t, uint64(0), a.AllocNum())
+	}
+	assert.Equal(t, uint64(0), a.NumFree())
+	assert.Equal(t, uint64(0), a.AllocNum(), "full allocator")
+	a.FreeNum(5)
+	assert.Equal(t, uint64(5), a.AllocNum(), "should wrap around to find 5")
+}
+
+func TestFreeNumErr(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(32)
+	assert.ErrorIs(a.FreeNumErr(0), ErrInvalidNum, "0 is reserved")
+	assert.ErrorIs(a.FreeNumErr(32), ErrInvalidNum, "past the end")
+	assert.Panics(func() { a.FreeNum(0) })
+
+	n := a.AllocNum()
+	assert.NoError(a.FreeNumErr(n))
+	assert.Equal(uint64(31), a.NumFree())
+}
+
+func TestFreeExtentErr(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(SHARDBITS)
+	assert.ErrorIs(a.FreeExtentErr(0, 4), ErrInvalidNum, "0 is reserved")
+	assert.ErrorIs(a.FreeExtentErr(SHARDBITS-2, 4), ErrInvalidNum, "past the end")
+	assert.ErrorIs(a.FreeExtentErr(SHARDBITS+10, 1), ErrInvalidNum, "past the end")
+	assert.Panics(func() { a.FreeExtent(SHARDBITS, 1) })
+
+	start, n := a.AllocExtent(4, 4)
+	assert.Equal(uint64(4), n)
+	assert.NoError(a.FreeExtentErr(start, n))
+	assert.Equal(SHARDBITS-1, a.NumFree())
+	checkSummaries(t, a)
+}
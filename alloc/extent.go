@@ -0,0 +1,262 @@
+package alloc
+
+import (
+	"fmt"
+)
+
+// The allocator keeps a summary of each chunk of SUMMARYBITS numbers, so that
+// searching for a run of free numbers can skip chunks that cannot contain or
+// extend one, rather than scanning the whole bitmap.
+//
+// Allocating or freeing a number only adjusts its chunk's free count and marks
+// the chunk's run lengths stale; they are recomputed when a search for a run
+// next needs them, so single-number operations never scan a chunk.
+
+const SUMMARYBITS uint64 = 512
+
+// summary describes the free numbers in a chunk
+type summary struct {
+	free  uint64 // number of free numbers in the chunk
+	stale bool   // start, end and max need to be recomputed
+	start uint64 // length of the free run at the start of the chunk
+	end   uint64 // length of the free run at the end of the chunk
+	max   uint64 // length of the longest free run in the chunk
+}
+
+func (a *Alloc) numBits() uint64 {
+	return 8 * uint64(len(a.bitmap))
+}
+
+func (a *Alloc) isFree(num uint64) bool {
+	return a.bitmap[num/8]&(1<<(num%8)) == 0
+}
+
+func numChunks(nbits uint64) uint64 {
+	return (nbits + SUMMARYBITS - 1) / SUMMARYBITS
+}
+
+// chunkBounds returns the numbers [lo, hi) in chunk c
+func (a *Alloc) chunkBounds(c uint64) (uint64, uint64) {
+	lo := c * SUMMARYBITS
+	hi := lo + SUMMARYBITS
+	if hi > a.numBits() {
+		hi = a.numBits()
+	}
+	return lo, hi
+}
+
+// summarize computes the summary of chunk c from the bitmap
+func (a *Alloc) summarize(c uint64) summary {
+	lo, hi := a.chunkBounds(c)
+	var s summary
+	var run uint64
+	var atStart = true
+	for num := lo; num < hi; num++ {
+		if a.isFree(num) {
+			s.free++
+			run++
+			if run > s.max {
+				s.max = run
+			}
+		} else {
+			if atStart {
+				s.start = run
+				atStart = false
+			}
+			run = 0
+		}
+	}
+	if atStart {
+		s.start = run
+	}
+	s.end = run
+	return s
+}
+
+// runSummary returns the summary of chunk c, first recomputing its run
+// lengths if they are stale. A chunk that is entirely free or entirely used
+// does not need to be scanned.
+//
+// Assumes caller holds the lock for c's shard.
+func (a *Alloc) runSummary(c uint64) summary {
+	s := &a.sums[c]
+	if !s.stale {
+		return *s
+	}
+	lo, hi := a.chunkBounds(c)
+	if s.free == 0 || s.free == hi-lo {
+		s.start, s.end, s.max = s.free, s.free, s.free
+		s.stale = false
+	} else {
+		*s = a.summarize(c)
+	}
+	return *s
+}
+
+func (a *Alloc) initSummaries() {
+	a.sums = make([]summary, numChunks(a.numBits()))
+	for c := range a.sums {
+		a.sums[c] = a.summarize(uint64(c))
+	}
+}
+
+// firstRun returns the start of the first run of n free numbers in [lo, hi),
+// which must exist
+func (a *Alloc) firstRun(lo uint64, hi uint64, n uint64) uint64 {
+	var run uint64
+	for num := lo; num < hi; num++ {
+		if a.isFree(num) {
+			run++
+			if run == n {
+				return num + 1 - n
+			}
+		} else {
+			run = 0
+		}
+	}
+	panic("alloc: summary is inconsistent with bitmap")
+}
+
+// firstFit allocates the first run of n free numbers, if there is one.
+// Otherwise it allocates nothing, and returns the first of the longest runs of
+// free numbers it saw.
+//
+// The chunks are searched in order, locking each shard on reaching it; earlier
+// shards stay locked only while the free run being followed extends into them,
+// so that a run that is found can be allocated.
+func (a *Alloc) firstFit(n uint64) (uint64, uint64, bool) {
+	var bestStart, bestLen uint64
+	// the free run ending at the current chunk
+	var runStart, runLen uint64
+	// shards [lockedLo, lockedHi) are locked
+	var lockedLo, lockedHi uint64
+	for c := range a.sums {
+		lo, hi := a.chunkBounds(uint64(c))
+		if a.shardOf(lo) >= lockedHi {
+			a.shards[a.shardOf(lo)].Lock()
+			lockedHi = a.shardOf(lo) + 1
+		}
+		s := a.runSummary(uint64(c))
+		if runLen == 0 {
+			runStart = lo
+		}
+		var start = runStart
+		var found = runLen+s.start >= n
+		if !found && s.max >= n {
+			start = a.firstRun(lo, hi, n)
+			found = true
+		}
+		if found {
+			a.setRange(start, n, true)
+			a.unlockShards(lockedLo, lockedHi)
+			return start, n, true
+		}
+		if runLen+s.start > bestLen {
+			bestStart, bestLen = runStart, runLen+s.start
+		}
+		if s.max > bestLen {
+			bestStart, bestLen = a.firstRun(lo, hi, s.max), s.max
+		}
+		if s.start == hi-lo {
+			runLen += hi - lo
+		} else {
+			runLen = s.end
+			runStart = hi - s.end
+		}
+		// release the shards before the run, which no longer matter
+		var keep = a.shardOf(hi)
+		if runLen > 0 {
+			keep = a.shardOf(runStart)
+		}
+		for lockedLo < keep && lockedLo < lockedHi {
+			a.shards[lockedLo].Unlock()
+			lockedLo++
+		}
+	}
+	a.unlockShards(lockedLo, lockedHi)
+	return bestStart, bestLen, false
+}
+
+func (a *Alloc) unlockShards(lo uint64, hi uint64) {
+	for s := lo; s < hi; s++ {
+		a.shards[s].Unlock()
+	}
+}
+
+// allocIfFree allocates [start, start+n) if it is still entirely free.
+func (a *Alloc) allocIfFree(start uint64, n uint64) bool {
+	a.lockRange(start, start+n)
+	defer a.unlockRange(start, start+n)
+	for num := start; num < start+n; num++ {
+		if !a.isFree(num) {
+			return false
+		}
+	}
+	a.setRange(start, n, true)
+	return true
+}
+
+// setRange marks [start, start+n) used or free.
+//
+// Assumes caller holds the locks for the shards containing the range.
+func (a *Alloc) setRange(start uint64, n uint64, used bool) {
+	for num := start; num < start+n; num++ {
+		a.setBit(num, used)
+	}
+}
+
+// AllocExtent allocates a run of between min and max contiguous free
+// numbers, returning its start and length.
+//
+// It allocates max numbers from the first run that is long enough (first
+// fit). If there is none, it allocates as much as it can from the longest run,
+// provided that has at least min numbers. Returns a length of 0 if there is no
+// run of min free numbers.
+//
+// Requires 0 < min <= max.
+func (a *Alloc) AllocExtent(min uint64, max uint64) (uint64, uint64) {
+	if !(0 < min && min <= max) {
+		panic("AllocExtent: invalid bounds")
+	}
+	for {
+		start, n, ok := a.firstFit(max)
+		if ok {
+			return start, n
+		}
+		if n < min {
+			return 0, 0
+		}
+		// the longest run was found without holding the locks of the
+		// shards before it; retry if it has been allocated since
+		if a.allocIfFree(start, n) {
+			return start, n
+		}
+	}
+}
+
+// FreeExtent frees the n numbers starting at start.
+//
+// Panics if the extent is invalid (see FreeExtentErr).
+func (a *Alloc) FreeExtent(start uint64, n uint64) {
+	err := a.FreeExtentErr(start, n)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// FreeExtentErr is like FreeExtent, but returns an error wrapping
+// ErrInvalidNum rather than panicking if the extent includes 0 or extends past
+// the end of the bitmap.
+func (a *Alloc) FreeExtentErr(start uint64, n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	if start == 0 || start >= a.numBits() || n > a.numBits()-start {
+		return fmt.Errorf("%w: extent [%d, %d+%d) (bitmap has %d numbers)",
+			ErrInvalidNum, start, start, n, a.numBits())
+	}
+	a.lockRange(start, start+n)
+	a.setRange(start, n, false)
+	a.unlockRange(start, start+n)
+	return nil
+}
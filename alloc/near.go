@@ -0,0 +1,240 @@
+package alloc
+
+// group is an allocation group, a region of numbers with its own cursor
+type group struct {
+	start uint64
+	end   uint64
+	next  uint64 // next number to try in [start, end)
+}
+
+// MkAllocGroups is like MkAlloc, but divides the numbers into ngroups
+// allocation groups of (nearly) equal size, for use with AllocGroup.
+//
+// Requires ngroups > 0.
+func MkAllocGroups(bitmap []byte, ngroups uint64) *Alloc {
+	if ngroups == 0 {
+		panic("MkAllocGroups: need at least one group")
+	}
+	a := MkAlloc(bitmap)
+	size := (a.numBits() + ngroups - 1) / ngroups
+	for g := uint64(0); g < ngroups; g++ {
+		start := g * size
+		end := start + size
+		if end > a.numBits() {
+			end = a.numBits()
+		}
+		if start > end {
+			start = end
+		}
+		a.groups = append(a.groups, group{start: start, end: end, next: start})
+	}
+	return a
+}
+
+// NumGroups returns the number of allocation groups (1 if the allocator was
+// not created with MkAllocGroups).
+func (a *Alloc) NumGroups() uint64 {
+	if a.groups == nil {
+		return 1
+	}
+	return uint64(len(a.groups))
+}
+
+// GroupOf returns the allocation group containing num.
+func (a *Alloc) GroupOf(num uint64) uint64 {
+	for g, gr := range a.groups {
+		if num < gr.end {
+			return uint64(g)
+		}
+	}
+	return 0
+}
+
+// nextFree returns the first free number in [lo, hi), skipping full chunks
+//
+// Assumes caller holds the locks for the shards containing [lo, hi).
+func (a *Alloc) nextFree(lo uint64, hi uint64) (uint64, bool) {
+	var num = lo
+	for num < hi {
+		c := num / SUMMARYBITS
+		if a.sums[c].free == 0 {
+			num = (c + 1) * SUMMARYBITS
+			continue
+		}
+		if a.isFree(num) {
+			return num, true
+		}
+		num++
+	}
+	return 0, false
+}
+
+// AllocGroup allocates a free number from allocation group g, starting from
+// where the group's last allocation left off, so that numbers allocated from
+// the same group are close together. If the group is full, it allocates the
+// free number nearest to the group.
+//
+// Returns 0 if there are no free numbers.
+func (a *Alloc) AllocGroup(g uint64) uint64 {
+	if a.groups == nil {
+		return a.AllocNum()
+	}
+	gr := &a.groups[g%uint64(len(a.groups))]
+	// only lock the shards of this group, so allocations from groups in
+	// different shards proceed in parallel
+	a.lockRange(gr.start, gr.end)
+	num, ok := a.nextFree(gr.next, gr.end)
+	if !ok {
+		num, ok = a.nextFree(gr.start, gr.next)
+	}
+	if ok {
+		a.setRange(num, 1, true)
+		gr.next = num + 1
+		a.unlockRange(gr.start, gr.end)
+		return num
+	}
+	a.unlockRange(gr.start, gr.end)
+
+	num, ok = a.allocNearest(gr.start)
+	if !ok {
+		return 0
+	}
+	return num
+}
+
+func distance(x uint64, y uint64) uint64 {
+	if x < y {
+		return y - x
+	}
+	return x - y
+}
+
+// nearestInChunk returns the free number in chunk c closest to hint,
+// preferring the lower one on a tie
+//
+// The chunk is scanned from the end nearest hint (or outward from hint, if it
+// is in the chunk), stopping at the first free number.
+//
+// Assumes caller holds the lock for c's shard.
+func (a *Alloc) nearestInChunk(c uint64, hint uint64) (uint64, bool) {
+	if a.sums[c].free == 0 {
+		return 0, false
+	}
+	lo, hi := a.chunkBounds(c)
+	if hint < lo {
+		return a.nextFree(lo, hi)
+	}
+	if hint >= hi {
+		for num := hi; num > lo; num-- {
+			if a.isFree(num - 1) {
+				return num - 1, true
+			}
+		}
+		return 0, false
+	}
+	for d := uint64(0); hint >= lo+d || hint+d < hi; d++ {
+		if hint >= lo+d && a.isFree(hint-d) {
+			return hint - d, true
+		}
+		if hint+d < hi && a.isFree(hint+d) {
+			return hint + d, true
+		}
+	}
+	return 0, false
+}
+
+// nearestFree returns the free number in [lo, hi) closest to hint, preferring
+// the lower one on a tie. lo and hi must be chunk boundaries (or the end of
+// the bitmap), and hint must be in [lo, hi).
+//
+// The search proceeds outward from hint's chunk, one chunk in each direction
+// at a time. Chunks in ring d are at least (d-1)*SUMMARYBITS away from hint, so
+// once a free number is found the search only needs to look at one more ring.
+//
+// Assumes caller holds the locks for the shards containing [lo, hi).
+func (a *Alloc) nearestFree(hint uint64, lo uint64, hi uint64) (uint64, bool) {
+	clo := lo / SUMMARYBITS
+	chi := numChunks(hi)
+	c := hint / SUMMARYBITS
+	var best uint64
+	var found = false
+	var lastRing = chi
+	for d := uint64(0); d <= lastRing && (c >= clo+d || c+d < chi); d++ {
+		var candidates []uint64
+		if c >= clo+d {
+			candidates = append(candidates, c-d)
+		}
+		if d > 0 && c+d < chi {
+			candidates = append(candidates, c+d)
+		}
+		for _, cc := range candidates {
+			num, ok := a.nearestInChunk(cc, hint)
+			if ok && (!found || distance(num, hint) < distance(best, hint) ||
+				(distance(num, hint) == distance(best, hint) && num < best)) {
+				best = num
+				found = true
+				if lastRing == chi {
+					lastRing = d + 1
+				}
+			}
+		}
+	}
+	return best, found
+}
+
+// allocNearest allocates the free number closest to hint, preferring the
+// lower one on a tie.
+//
+// Only the shards being searched are locked: the search starts with hint's
+// shard, and widens by one shard on each side that could still hold a closer
+// free number, until the window holds the answer or the whole bitmap.
+func (a *Alloc) allocNearest(hint uint64) (uint64, bool) {
+	nbits := a.numBits()
+	if nbits == 0 {
+		return 0, false
+	}
+	if hint >= nbits {
+		hint = nbits - 1
+	}
+	var slo = a.shardOf(hint)
+	var shi = slo + 1
+	for {
+		lo := slo * SHARDBITS
+		hi := shi * SHARDBITS
+		if hi > nbits {
+			hi = nbits
+		}
+		a.lockRange(lo, hi)
+		num, ok := a.nearestFree(hint, lo, hi)
+		// the nearest numbers outside the window are lo-1, which would win
+		// a tie, and hi, which would not
+		leftDone := lo == 0 || (ok && distance(num, hint) < hint-lo+1)
+		rightDone := hi == nbits || (ok && distance(num, hint) <= hi-hint)
+		if leftDone && rightDone {
+			if ok {
+				a.setRange(num, 1, true)
+			}
+			a.unlockRange(lo, hi)
+			return num, ok
+		}
+		a.unlockRange(lo, hi)
+		if !leftDone {
+			slo--
+		}
+		if !rightDone {
+			shi++
+		}
+	}
+}
+
+// AllocNear allocates the free number closest to hint, so that related
+// objects (such as the blocks of one file) can be allocated close together.
+//
+// Returns 0 if there are no free numbers.
+func (a *Alloc) AllocNear(hint uint64) uint64 {
+	num, ok := a.allocNearest(hint)
+	if !ok {
+		return 0
+	}
+	return num
+}
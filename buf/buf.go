@@ -29,6 +29,9 @@ func MkBuf(addr addr.Addr, sz uint64, data []byte) *Buf {
 }
 
 // Load the bits of a disk block into a new buf, as specified by addr
+//
+// The buf's data holds the bytes of blk that contain the object, so an object
+// that does not start on a byte boundary starts at bit addr.Off%8 of Data[0].
 func MkBufLoad(addr addr.Addr, sz uint64, blk disk.Block) *Buf {
 	bytefirst := addr.Off / 8
 	bytelast := (addr.Off + sz - 1) / 8
@@ -72,7 +75,27 @@ func installBytes(src []byte, dst []byte, dstoff uint64, nbit uint64) {
 	return
 }
 
-// Install the bits from buf into blk.  Two cases: a bit or an inode
+// Install nbit bits from src to dst, at dstoff in destination. dstoff is in
+// bits, and src is laid out as in MkBufLoad, starting at bit dstoff%8 of
+// src[0]. Bits of dst outside the object are unchanged.
+func installBits(src []byte, dst []byte, dstoff uint64, nbit uint64) {
+	first := dstoff / 8
+	end := dstoff + nbit
+	last := (end - 1) / 8
+	for i := first; i <= last; i++ {
+		var mask byte = 0xff
+		if i == first {
+			mask = mask & (0xff << (dstoff % 8))
+		}
+		if i == last && end%8 != 0 {
+			mask = mask & (0xff >> (8 - end%8))
+		}
+		dst[i] = (dst[i] & ^mask) | (src[i-first] & mask)
+	}
+}
+
+// Install the bits from buf into blk.  Bits and byte-aligned objects like
+// inodes are installed directly; other objects are installed bit by bit.
 func (buf *Buf) Install(blk disk.Block) {
 	util.DPrintf(5, "%v: install\n", buf.Addr)
 	if buf.Sz == 1 {
@@ -80,7 +103,7 @@ func (buf *Buf) Install(blk disk.Block) {
 	} else if buf.Sz%8 == 0 && buf.Addr.Off%8 == 0 {
 		installBytes(buf.Data, blk, buf.Addr.Off, buf.Sz)
 	} else {
-		panic("Install unsupported\n")
+		installBits(buf.Data, blk, buf.Addr.Off, buf.Sz)
 	}
 	util.DPrintf(20, "install -> %v\n", blk)
 }
@@ -3,9 +3,14 @@ package buf
 import (
 	"github.com/goose-lang/primitive/disk"
 
+	"math/rand"
 	"testing"
+	"testing/quick"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
 )
 
 func TestInstallOneBit(t *testing.T) {
@@ -33,3 +38,82 @@ func TestInstallBytes(t *testing.T) {
 	assert.Equal(t, byte(0xF0), dst[2])
 	assert.Equal(t, byte(0xF0), dst[3])
 }
+
+func TestInstallBits(t *testing.T) {
+	// a 4-bit field in the middle of a byte
+	dst := []byte{0xFF}
+	installBits([]byte{0x00}, dst, 2, 4)
+	assert.Equal(t, byte(0xC3), dst[0])
+
+	// a 12-bit counter spanning two bytes
+	dst = []byte{0x00, 0x00, 0x00}
+	installBits([]byte{0xF0, 0xFF}, dst, 4, 12)
+	assert.Equal(t, []byte{0xF0, 0xFF, 0x00}, dst)
+}
+
+func randomBlock(rng *rand.Rand) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	rng.Read(b)
+	return b
+}
+
+func getBit(b []byte, off uint64) bool {
+	return b[off/8]&(1<<(off%8)) != 0
+}
+
+// randomObject picks an object of at most 128 bits (or occasionally a larger
+// one) anywhere in a block
+func randomObject(rng *rand.Rand) (uint64, uint64) {
+	var maxSz uint64 = 128
+	if rng.Intn(10) == 0 {
+		maxSz = common.NBITBLOCK
+	}
+	sz := 1 + uint64(rng.Int63n(int64(maxSz)))
+	off := uint64(rng.Int63n(int64(common.NBITBLOCK - sz + 1)))
+	return off, sz
+}
+
+func TestInstallProperty(t *testing.T) {
+	prop := func(seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		off, sz := randomObject(rng)
+		a := addr.MkAddr(513, off)
+		src := randomBlock(rng)
+		b := MkBufLoad(a, sz, src)
+		dst := randomBlock(rng)
+		orig := append(disk.Block{}, dst...)
+		b.Install(dst)
+		for bit := uint64(0); bit < common.NBITBLOCK; bit++ {
+			if off <= bit && bit < off+sz {
+				if getBit(dst, bit) != getBit(src, bit) {
+					t.Logf("off=%d sz=%d: bit %d not installed", off, sz, bit)
+					return false
+				}
+			} else if getBit(dst, bit) != getBit(orig, bit) {
+				t.Logf("off=%d sz=%d: bit %d outside object changed", off, sz, bit)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(prop, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadInstallRoundTrip(t *testing.T) {
+	prop := func(seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		off, sz := randomObject(rng)
+		a := addr.MkAddr(513, off)
+		blk := randomBlock(rng)
+		orig := append(disk.Block{}, blk...)
+		// installing an object loaded from a block leaves the block unchanged
+		b := MkBufLoad(a, sz, append(disk.Block{}, blk...))
+		b.Install(blk)
+		return assert.Equal(t, orig, blk, "off=%d sz=%d", off, sz)
+	}
+	if err := quick.Check(prop, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,140 @@
+// Command jrnlfsck checks the journal in a disk image offline, and optionally
+// repairs it (see package fsck).
+//
+// Usage:
+//
+//	jrnlfsck [-schema file] [-repair replay|truncate] <image>
+//
+// The schema file describes one region per line as
+//
+//	name start len objsz
+//
+// with the start and length in blocks and the object size in bits; blank
+// lines and lines starting with # are ignored.
+//
+// The exit status is 0 if the journal is clean (after any repair), 1 if
+// problems remain, and 2 for usage errors or a disk without a usable journal.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mit-pdos/go-journal/filedisk"
+	"github.com/mit-pdos/go-journal/fsck"
+	"github.com/mit-pdos/go-journal/schema"
+)
+
+func parseSchema(path string) (*schema.Schema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var regions []schema.Region
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var r schema.Region
+		_, err := fmt.Sscan(text, &r.Name, &r.Start, &r.Len, &r.ObjSz)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		regions = append(regions, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return schema.New(regions...)
+}
+
+// fail reports err and returns the exit status for it
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "jrnlfsck:", err)
+	return 2
+}
+
+func report(r *fsck.Report) {
+	fmt.Printf("log: [%d, %d), recovery replays [%d, %d)\n",
+		r.Log.Start, r.Log.End, r.Log.Start, r.Log.ValidEnd)
+	for _, p := range r.Problems {
+		fmt.Println(p)
+	}
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// run implements jrnlfsck and returns its exit status, so that deferred
+// cleanup runs before the program exits.
+func run() (status int) {
+	schemaFile := flag.String("schema", "", "check logged blocks against the regions in `file`")
+	repair := flag.String("repair", "", "repair the log by `mode` replay or truncate")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [-schema file] [-repair replay|truncate] <image>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return 2
+	}
+	var mode fsck.Mode
+	switch *repair {
+	case "":
+	case "replay":
+		mode = fsck.Replay
+	case "truncate":
+		mode = fsck.Truncate
+	default:
+		return fail(fmt.Errorf("unknown repair mode %q", *repair))
+	}
+	var sch *schema.Schema
+	if *schemaFile != "" {
+		var err error
+		sch, err = parseSchema(*schemaFile)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	d, err := filedisk.Open(flag.Arg(0), 0, filedisk.Opts{ReadOnly: *repair == ""})
+	if err != nil {
+		return fail(err)
+	}
+	defer func() {
+		// make any repair durable, even if it failed part way
+		if err := d.BarrierErr(); err != nil {
+			status = fail(err)
+		}
+		d.Close()
+	}()
+	r, err := fsck.Check(d, sch)
+	if err != nil {
+		return fail(err)
+	}
+	report(r)
+	if *repair != "" {
+		if err := fsck.Repair(d, mode); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("repaired (%s)\n", *repair)
+		r, err = fsck.Check(d, sch)
+		if err != nil {
+			return fail(err)
+		}
+		report(r)
+	}
+	if !r.Clean() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+// Command waldump prints the on-disk state of a journal in a disk image, for
+// debugging recovery.
+//
+// Usage:
+//
+//	waldump [-diff] <image>
+//
+// It prints the superblock, the log bounds from the two headers, and for each
+// logged position the home address of the block, whether its checksum is
+// valid, and whether recovery would replay it. With -diff, it also compares
+// each logged block with its home location. The image is opened read only.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/filedisk"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+// diffBlocks describes how the logged block differs from its home block
+func diffBlocks(logged disk.Block, home disk.Block) string {
+	if bytes.Equal(logged, home) {
+		return "installed"
+	}
+	var first = -1
+	var n = 0
+	for i := range logged {
+		if logged[i] != home[i] {
+			if first < 0 {
+				first = i
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("differs in %d bytes (first at offset %d)", n, first)
+}
+
+func dump(w io.Writer, d disk.Disk, diff bool) error {
+	info, err := wal.Inspect(d)
+	if err != nil {
+		return err
+	}
+	s := info.Super
+	fmt.Fprintf(w, "superblock: version %d, block size %d, log %d blocks at %d, data at %d\n",
+		s.Version, s.BlockSize, s.LogSz, s.LogStart, s.DataStart)
+	fmt.Fprintf(w, "hdr2: start %d\n", info.Start)
+	fmt.Fprintf(w, "hdr:  end %d\n", info.End)
+	if info.HdrErr != nil {
+		fmt.Fprintf(w, "headers are invalid, recovery would fail: %v\n", info.HdrErr)
+	} else {
+		fmt.Fprintf(w, "recovery replays [%d, %d) (%d of %d blocks)\n",
+			info.Start, info.ValidEnd, info.ValidEnd-info.Start, info.End-info.Start)
+	}
+	for _, e := range info.Entries {
+		var flags = ""
+		if e.Last {
+			flags += " last"
+		}
+		if !e.ChecksumOK {
+			flags += " bad-checksum"
+		}
+		if e.Replayed {
+			flags += " replay"
+		} else {
+			flags += " skip"
+		}
+		fmt.Fprintf(w, "pos %d: block %d -> addr %d:%s", e.Pos, e.LogBlock, e.Addr, flags)
+		if diff {
+			if e.Addr >= d.Size() {
+				fmt.Fprintf(w, " (addr out of range)")
+			} else {
+				fmt.Fprintf(w, " (%s)", diffBlocks(d.Read(e.LogBlock), d.Read(e.Addr)))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func main() {
+	diff := flag.Bool("diff", false, "compare logged blocks with their home locations")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-diff] <image>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	d, err := filedisk.Open(flag.Arg(0), 0, filedisk.Opts{ReadOnly: true})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer d.Close()
+	if err := dump(os.Stdout, d, *diff); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,159 @@
+// Package codec encodes fixed-size structs as the byte layout of disk objects,
+// so that callers of txn.Txn and jrnl.Op do not have to marshal objects by
+// hand.
+//
+// A struct can contain fields of type uint64 (including common.Bnum), uint32,
+// uint8, and bool, arrays of these, and nested structs of the same kind. All
+// fields are encoded in order, with no padding, in the little-endian layout
+// used by github.com/tchajed/marshal. Unexported fields and fields of any
+// other type (including slices, strings, and pointers) are rejected, since
+// they have no fixed size.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/addr"
+)
+
+// ErrSize is returned when an encoded struct does not have the size of the
+// object it is read from or written to.
+var ErrSize = errors.New("codec: encoded size does not match object size")
+
+// ErrUnsupported is returned for types that cannot be encoded, and for objects
+// that do not start on a byte boundary.
+var ErrUnsupported = errors.New("codec: unsupported type")
+
+// Check checks that a T can be stored in the object of sz bits at a, without
+// encoding anything.
+func Check[T any](a addr.Addr, sz uint64) error {
+	if a.Off%8 != 0 {
+		return fmt.Errorf("%w: object at bit offset %d is not byte-aligned",
+			ErrUnsupported, a.Off)
+	}
+	return checkSize(reflect.TypeFor[T](), sz)
+}
+
+// typeSize returns the encoded size of t in bytes
+func typeSize(t reflect.Type) (uint64, error) {
+	switch t.Kind() {
+	case reflect.Uint64:
+		return 8, nil
+	case reflect.Uint32:
+		return 4, nil
+	case reflect.Uint8, reflect.Bool:
+		return 1, nil
+	case reflect.Array:
+		elem, err := typeSize(t.Elem())
+		if err != nil {
+			return 0, err
+		}
+		return uint64(t.Len()) * elem, nil
+	case reflect.Struct:
+		var sz uint64
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				return 0, fmt.Errorf("%w: unexported field %s.%s",
+					ErrUnsupported, t, f.Name)
+			}
+			fsz, err := typeSize(f.Type)
+			if err != nil {
+				return 0, err
+			}
+			sz += fsz
+		}
+		return sz, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnsupported, t)
+}
+
+// Size returns the encoded size of a T in bits, the object size to use for it.
+func Size[T any]() (uint64, error) {
+	sz, err := typeSize(reflect.TypeFor[T]())
+	return 8 * sz, err
+}
+
+func checkSize(t reflect.Type, sz uint64) error {
+	tsz, err := typeSize(t)
+	if err != nil {
+		return err
+	}
+	if 8*tsz != sz {
+		return fmt.Errorf("%w: %s is %d bits, object is %d bits",
+			ErrSize, t, 8*tsz, sz)
+	}
+	return nil
+}
+
+func encode(enc marshal.Enc, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Uint64:
+		enc.PutInt(v.Uint())
+	case reflect.Uint32:
+		enc.PutInt32(uint32(v.Uint()))
+	case reflect.Uint8:
+		enc.PutBytes([]byte{byte(v.Uint())})
+	case reflect.Bool:
+		enc.PutBool(v.Bool())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			encode(enc, v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			encode(enc, v.Field(i))
+		}
+	}
+}
+
+func decode(dec marshal.Dec, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Uint64:
+		v.SetUint(dec.GetInt())
+	case reflect.Uint32:
+		v.SetUint(uint64(dec.GetInt32()))
+	case reflect.Uint8:
+		v.SetUint(uint64(dec.GetBytes(1)[0]))
+	case reflect.Bool:
+		v.SetBool(dec.GetBool())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			decode(dec, v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			decode(dec, v.Field(i))
+		}
+	}
+}
+
+// Encode encodes v as an object of sz bits.
+func Encode[T any](v T, sz uint64) ([]byte, error) {
+	rv := reflect.ValueOf(&v).Elem()
+	if err := checkSize(rv.Type(), sz); err != nil {
+		return nil, err
+	}
+	enc := marshal.NewEnc(sz / 8)
+	encode(enc, rv)
+	return enc.Finish(), nil
+}
+
+// Decode decodes an object of sz bits, whose contents are data.
+func Decode[T any](data []byte, sz uint64) (T, error) {
+	var v T
+	rv := reflect.ValueOf(&v).Elem()
+	if err := checkSize(rv.Type(), sz); err != nil {
+		return v, err
+	}
+	if uint64(len(data)) < sz/8 {
+		return v, fmt.Errorf("%w: %d bytes of data for a %d-bit object",
+			ErrSize, len(data), sz)
+	}
+	decode(marshal.NewDec(data), rv)
+	return v, nil
+}
@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+)
+
+type inode struct {
+	Size   uint64
+	Nlink  uint32
+	Kind   uint8
+	Dirty  bool
+	Blocks [4]common.Bnum
+	Name   [6]byte
+}
+
+const inodeSz = 8 * (8 + 4 + 1 + 1 + 4*8 + 6)
+
+func TestSize(t *testing.T) {
+	sz, err := Size[inode]()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(inodeSz), sz)
+}
+
+func TestRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	v := inode{
+		Size:   1 << 40,
+		Nlink:  3,
+		Kind:   2,
+		Dirty:  true,
+		Blocks: [4]common.Bnum{513, 514, 0, 1000},
+		Name:   [6]byte{'f', 'o', 'o'},
+	}
+	data, err := Encode(v, inodeSz)
+	assert.NoError(err)
+	assert.Len(data, inodeSz/8)
+	v2, err := Decode[inode](data, inodeSz)
+	assert.NoError(err)
+	assert.Equal(v, v2)
+}
+
+func TestMarshalLayout(t *testing.T) {
+	type pair struct {
+		A uint64
+		B uint32
+	}
+	data, err := Encode(pair{A: 7, B: 9}, 96)
+	assert.NoError(t, err)
+	enc := marshal.NewEnc(12)
+	enc.PutInt(7)
+	enc.PutInt32(9)
+	assert.Equal(t, enc.Finish(), data)
+}
+
+func TestSizeMismatch(t *testing.T) {
+	_, err := Encode(inode{}, inodeSz+8)
+	assert.True(t, errors.Is(err, ErrSize), "got %v", err)
+	_, err = Decode[inode](make([]byte, 4), inodeSz)
+	assert.True(t, errors.Is(err, ErrSize), "got %v", err)
+	err = Check[uint64](addr.MkAddr(513, 0), 32)
+	assert.True(t, errors.Is(err, ErrSize), "got %v", err)
+}
+
+func TestUnsupported(t *testing.T) {
+	type withSlice struct {
+		Data []byte
+	}
+	type unexported struct {
+		x uint64
+	}
+	_, err := Size[withSlice]()
+	assert.True(t, errors.Is(err, ErrUnsupported))
+	_, err = Size[unexported]()
+	assert.True(t, errors.Is(err, ErrUnsupported))
+	err = Check[uint64](addr.MkAddr(513, 4), 64)
+	assert.True(t, errors.Is(err, ErrUnsupported), "unaligned object")
+}
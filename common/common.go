@@ -11,6 +11,11 @@ const (
 	INODEBLK     uint64 = disk.BlockSize / INODESZ
 	NINODEBITMAP uint64 = 1
 
+	// HDRMETA, HDRADDRS, and LOGSIZE describe the original log format, with a
+	// single header block of 8-byte addresses.
+	//
+	// Deprecated: the log now keeps checksummed address blocks; use
+	// wal.HDRADDRS and wal.LOGDISKBLOCKS instead.
 	HDRMETA  = uint64(8) // space for the end position
 	HDRADDRS = (disk.BlockSize - HDRMETA) / 8
 	LOGSIZE  = HDRADDRS + 2 // 2 for log header
@@ -0,0 +1,212 @@
+// Package crashdisk implements a disk.Disk for testing crash safety.
+//
+// A Disk wraps another disk, which holds the durable state, and buffers every
+// write since the last Barrier. A crash can persist any subset of those
+// buffered writes, which models a disk that reorders writes between
+// barriers; CrashState builds the disk that results from one such subset, so
+// tests can check recovery on arbitrary (or all) possible crash states.
+package crashdisk
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/util"
+)
+
+type pendingWrite struct {
+	a uint64
+	b disk.Block
+}
+
+// Disk records writes since the last barrier so that a crash can lose an
+// arbitrary subset of them.
+type Disk struct {
+	mu      *sync.Mutex
+	durable disk.Disk
+	// pending writes since the last barrier, in the order they were issued
+	pending []pendingWrite
+	// volatile is the latest contents of every block written since the last
+	// barrier
+	volatile map[uint64]disk.Block
+
+	crashed bool
+	// crash at this many more writes and barriers, if nonzero
+	crashAfter uint64
+}
+
+var _ disk.Disk = (*Disk)(nil)
+
+// New wraps the durable disk d.
+//
+// The contents of d are only updated at each Barrier.
+func New(d disk.Disk) *Disk {
+	return &Disk{
+		mu:       new(sync.Mutex),
+		durable:  d,
+		volatile: make(map[uint64]disk.Block),
+	}
+}
+
+func (d *Disk) ReadTo(a uint64, buf disk.Block) {
+	d.mu.Lock()
+	b, ok := d.volatile[a]
+	if ok {
+		copy(buf, b)
+	}
+	d.mu.Unlock()
+	if !ok {
+		d.durable.ReadTo(a, buf)
+	}
+}
+
+func (d *Disk) Read(a uint64) disk.Block {
+	buf := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, buf)
+	return buf
+}
+
+// Write buffers a write until the next barrier.
+//
+// After a crash, writes still update what Read returns (so that threads that
+// are still running see a consistent disk) but never become durable.
+func (d *Disk) Write(a uint64, v disk.Block) {
+	if uint64(len(v)) != disk.BlockSize {
+		panic(fmt.Errorf("v is not block-sized (%d bytes)", len(v)))
+	}
+	if a >= d.durable.Size() {
+		panic(fmt.Errorf("out-of-bounds write at %v", a))
+	}
+	b := util.CloneByteSlice(v)
+	d.mu.Lock()
+	d.countOp()
+	if !d.crashed {
+		d.pending = append(d.pending, pendingWrite{a: a, b: b})
+	}
+	d.volatile[a] = b
+	d.mu.Unlock()
+}
+
+// countOp counts a write or barrier towards the crash point, crashing if this
+// operation is the one to be lost
+//
+// Assumes caller holds mu.
+func (d *Disk) countOp() {
+	if d.crashAfter > 0 {
+		d.crashAfter--
+		if d.crashAfter == 0 {
+			d.crashed = true
+		}
+	}
+}
+
+func (d *Disk) Size() uint64 {
+	return d.durable.Size()
+}
+
+// Barrier makes all pending writes durable (unless the disk has crashed).
+func (d *Disk) Barrier() {
+	d.mu.Lock()
+	d.countOp()
+	if !d.crashed {
+		for _, w := range d.pending {
+			d.durable.Write(w.a, w.b)
+		}
+		d.durable.Barrier()
+		d.pending = nil
+		d.volatile = make(map[uint64]disk.Block)
+	}
+	d.mu.Unlock()
+}
+
+func (d *Disk) Close() {}
+
+// Crash simulates a crash. Subsequent writes and barriers have no durable
+// effect, and the possible states of the disk after the crash can be obtained
+// with CrashState.
+func (d *Disk) Crash() {
+	d.mu.Lock()
+	d.crashed = true
+	d.mu.Unlock()
+}
+
+// CrashAfter arranges for the disk to crash at the n-th subsequent disk
+// operation (write or barrier), which is the first one lost.
+//
+// Iterating over n gives a systematic way to crash at every write and barrier
+// of a workload.
+func (d *Disk) CrashAfter(n uint64) {
+	d.mu.Lock()
+	if n == 0 {
+		d.crashed = true
+	}
+	d.crashAfter = n
+	d.mu.Unlock()
+}
+
+// Crashed reports whether the disk has crashed.
+func (d *Disk) Crashed() bool {
+	d.mu.Lock()
+	crashed := d.crashed
+	d.mu.Unlock()
+	return crashed
+}
+
+// NumPending returns the number of writes since the last barrier (up to the
+// crash, if the disk has crashed).
+func (d *Disk) NumPending() int {
+	d.mu.Lock()
+	n := len(d.pending)
+	d.mu.Unlock()
+	return n
+}
+
+// CrashState returns a new disk with the durable contents of d plus the
+// pending writes i for which keep(i) is true, applied in order.
+//
+// The returned disk is independent of d, so CrashState can be called
+// repeatedly to explore different crash states.
+func (d *Disk) CrashState(keep func(i int) bool) disk.MemDisk {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := disk.NewMemDisk(d.durable.Size())
+	buf := make(disk.Block, disk.BlockSize)
+	for a := uint64(0); a < d.durable.Size(); a++ {
+		d.durable.ReadTo(a, buf)
+		m.Write(a, buf)
+	}
+	for i, w := range d.pending {
+		if keep(i) {
+			m.Write(w.a, w.b)
+		}
+	}
+	return m
+}
+
+// RandomCrashState returns a crash state in which each pending write is kept
+// with probability 1/2.
+func (d *Disk) RandomCrashState(rng *rand.Rand) disk.MemDisk {
+	return d.CrashState(func(i int) bool {
+		return rng.Intn(2) == 0
+	})
+}
+
+// AllCrashStates calls f on every possible crash state, one for each subset of
+// the pending writes.
+//
+// There are 2^NumPending() states, so callers should only use this for small
+// numbers of pending writes.
+func (d *Disk) AllCrashStates(f func(disk.Disk)) {
+	n := d.NumPending()
+	if n >= 63 {
+		panic("too many pending writes to enumerate")
+	}
+	for subset := uint64(0); subset < 1<<n; subset++ {
+		f(d.CrashState(func(i int) bool {
+			return subset&(1<<i) != 0
+		}))
+	}
+}
@@ -0,0 +1,256 @@
+package crashdisk_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/crashdisk"
+	"github.com/mit-pdos/go-journal/txn"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+func mkBlock(b byte) disk.Block {
+	block := make(disk.Block, disk.BlockSize)
+	for i := 0; i < 10; i++ {
+		block[i] = b
+	}
+	return block
+}
+
+func TestBarrier(t *testing.T) {
+	assert := assert.New(t)
+	mem := disk.NewMemDisk(10)
+	d := crashdisk.New(mem)
+	d.Write(1, mkBlock(1))
+	assert.Equal(mkBlock(1), d.Read(1), "writes should be visible")
+	assert.Equal(mkBlock(0), mem.Read(1), "writes should not be durable")
+	assert.Equal(1, d.NumPending())
+	d.Barrier()
+	assert.Equal(mkBlock(1), mem.Read(1))
+	assert.Equal(0, d.NumPending())
+}
+
+func TestCrashStates(t *testing.T) {
+	assert := assert.New(t)
+	d := crashdisk.New(disk.NewMemDisk(10))
+	d.Write(1, mkBlock(1))
+	d.Barrier()
+	d.Write(2, mkBlock(2))
+	d.Write(3, mkBlock(3))
+	d.Crash()
+	d.Write(4, mkBlock(4))
+	assert.Equal(mkBlock(4), d.Read(4), "crashed disk still reads writes")
+	assert.Equal(2, d.NumPending(), "writes after crash are not pending")
+
+	var states []disk.Disk
+	d.AllCrashStates(func(s disk.Disk) {
+		assert.Equal(mkBlock(1), s.Read(1), "barrier should persist writes")
+		assert.Equal(mkBlock(0), s.Read(4), "write after crash was lost")
+		states = append(states, s)
+	})
+	assert.Len(states, 4)
+	assert.Equal(mkBlock(0), states[0].Read(2))
+	assert.Equal(mkBlock(0), states[0].Read(3))
+	assert.Equal(mkBlock(2), states[3].Read(2))
+	assert.Equal(mkBlock(3), states[3].Read(3))
+}
+
+func TestCrashAfter(t *testing.T) {
+	assert := assert.New(t)
+	d := crashdisk.New(disk.NewMemDisk(10))
+	d.CrashAfter(3)
+	d.Write(1, mkBlock(1))
+	d.Barrier()
+	assert.False(d.Crashed())
+	d.Write(2, mkBlock(2))
+	assert.True(d.Crashed())
+	d.Barrier()
+	s := d.CrashState(func(i int) bool { return true })
+	assert.Equal(mkBlock(1), s.Read(1))
+	assert.Equal(mkBlock(0), s.Read(2), "crashing write should be lost")
+
+	d = crashdisk.New(disk.NewMemDisk(10))
+	d.CrashAfter(2)
+	d.Write(1, mkBlock(1))
+	d.Barrier()
+	assert.True(d.Crashed(), "should crash at the barrier")
+	assert.Equal(1, d.NumPending(), "barrier should not take effect")
+}
+
+//
+// Recovery harness for txn
+//
+
+const numTxns = 6
+const inodeSz uint64 = 8 * 128
+
+// objects written by every transaction in the workload: two whole blocks and
+// an inode that shares its block with untouched neighbors
+var objects = []struct {
+	a  addr.Addr
+	sz uint64
+}{
+	{addr.MkAddr(wal.LOGDISKBLOCKS+1, 0), 8 * disk.BlockSize},
+	{addr.MkAddr(wal.LOGDISKBLOCKS+2, 0), 8 * disk.BlockSize},
+	{addr.MkAddr(wal.LOGDISKBLOCKS+5, 3*inodeSz), inodeSz},
+}
+
+func objData(sz uint64, v byte) []byte {
+	data := make([]byte, sz/8)
+	for i := range data {
+		data[i] = v
+	}
+	return data
+}
+
+// runWorkload commits transactions 1..numTxns, each overwriting every object
+// with its transaction number, and returns the last transaction that was
+// durably committed before the disk crashed.
+func runWorkload(t *testing.T, d *crashdisk.Disk) byte {
+	tsys := txn.Init(d)
+	var durable byte = 0
+	for i := byte(1); i <= numTxns; i++ {
+		tx := txn.Begin(tsys)
+		for _, o := range objects {
+			tx.OverWrite(o.a, o.sz, objData(o.sz, i))
+		}
+		wait := i%2 == 0
+		require.True(t, tx.Commit(wait))
+		if wait && !d.Crashed() {
+			durable = i
+		}
+	}
+	tsys.Shutdown()
+	return durable
+}
+
+// checkRecovery recovers a crash state and checks that it reflects a prefix
+// of the committed transactions that includes at least the durable ones.
+func checkRecovery(t *testing.T, d disk.Disk, durable byte) {
+	t.Helper()
+	tsys := txn.Init(d)
+	tx := txn.Begin(tsys)
+	v := tx.ReadBuf(objects[0].a, objects[0].sz)[0]
+	assert.GreaterOrEqual(t, v, durable, "durable transaction was lost")
+	for _, o := range objects {
+		assert.Equal(t, objData(o.sz, v), tx.ReadBuf(o.a, o.sz),
+			"recovered a partial transaction")
+	}
+	// the inode's neighbors are never written
+	neighbor := addr.MkAddr(objects[2].a.Blkno, 2*inodeSz)
+	assert.Equal(t, objData(inodeSz, 0), tx.ReadBuf(neighbor, inodeSz))
+	tx.ReleaseAll()
+	tsys.Shutdown()
+}
+
+func TestTxnCrashRecovery(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := uint64(1); ; n++ {
+		d := crashdisk.New(disk.NewMemDisk(wal.LOGDISKBLOCKS + 10))
+		d.CrashAfter(n)
+		durable := runWorkload(t, d)
+		if !d.Crashed() {
+			// the workload finished before the crash point
+			checkRecovery(t, d, numTxns)
+			break
+		}
+		if d.NumPending() <= 4 {
+			d.AllCrashStates(func(s disk.Disk) {
+				checkRecovery(t, s, durable)
+			})
+		} else {
+			for i := 0; i < 8; i++ {
+				checkRecovery(t, d.RandomCrashState(rng), durable)
+			}
+		}
+		if t.Failed() {
+			t.Fatalf("recovery failed when crashing at disk operation %d", n)
+		}
+	}
+}
+
+//
+// Recovery harness for wal
+//
+
+// walTxn writes i to blocks [i, i+4) of the data region, so consecutive
+// transactions overlap
+func walTxn(i byte) []wal.Update {
+	var txn []wal.Update
+	for j := uint64(0); j < 4; j++ {
+		a := wal.LOGDISKBLOCKS + uint64(i) + j
+		txn = append(txn, wal.MkBlockData(a, mkBlock(i)))
+	}
+	return txn
+}
+
+// expectedBlocks is the data region after transactions 1..n
+func expectedBlocks(n byte) map[uint64]disk.Block {
+	blocks := make(map[uint64]disk.Block)
+	for a := uint64(0); a < numTxns+4; a++ {
+		blocks[wal.LOGDISKBLOCKS+a] = mkBlock(0)
+	}
+	for i := byte(1); i <= n; i++ {
+		for _, u := range walTxn(i) {
+			blocks[u.Addr] = u.Block
+		}
+	}
+	return blocks
+}
+
+func checkWalRecovery(t *testing.T, d disk.Disk, durable byte) {
+	t.Helper()
+	l, err := wal.OpenLog(d, wal.LOGSZ)
+	require.NoError(t, err)
+	var prefixes []byte
+	for n := durable; n <= numTxns; n++ {
+		matches := true
+		for a, b := range expectedBlocks(n) {
+			if !assert.ObjectsAreEqual(b, l.Read(a)) {
+				matches = false
+			}
+		}
+		if matches {
+			prefixes = append(prefixes, n)
+		}
+	}
+	assert.NotEmpty(t, prefixes,
+		"recovered state is not a prefix including transaction %d", durable)
+	l.Shutdown()
+}
+
+func TestWalCrashRecovery(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := uint64(1); ; n++ {
+		d := crashdisk.New(disk.NewMemDisk(wal.LOGDISKBLOCKS + 20))
+		d.CrashAfter(n)
+		l := wal.MkLog(d, wal.LOGSZ)
+		var durable byte = 0
+		for i := byte(1); i <= numTxns; i++ {
+			pos, ok := l.MemAppend(walTxn(i))
+			require.True(t, ok)
+			if i%2 == 0 {
+				l.Flush(pos)
+				if !d.Crashed() {
+					durable = i
+				}
+			}
+		}
+		l.Shutdown()
+		if !d.Crashed() {
+			checkWalRecovery(t, d, numTxns)
+			break
+		}
+		for i := 0; i < 8; i++ {
+			checkWalRecovery(t, d.RandomCrashState(rng), durable)
+		}
+		if t.Failed() {
+			t.Fatalf("recovery failed when crashing at disk operation %d", n)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+//go:build unix
+
+// Package filedisk implements disk.Disk on top of a regular file or a block
+// device.
+//
+// Barrier is implemented with a durable flush (fdatasync on Linux), so a
+// journal running on a filedisk.Disk is crash safe as long as the underlying
+// storage honors flushes. The disk can optionally be opened with O_DIRECT to
+// bypass the page cache. The package is only available on unix systems.
+//
+// Like the disks in github.com/goose-lang/primitive/disk, I/O errors in Read,
+// Write and Barrier are fatal and cause a panic. WriteErr and BarrierErr
+// return write errors instead, which makes a Disk a wal.ErrorDisk.
+package filedisk
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/goose-lang/primitive/disk"
+	"golang.org/x/sys/unix"
+)
+
+// Opts configures how a disk is opened.
+type Opts struct {
+	// Direct opens the file with O_DIRECT, bypassing the page cache.
+	//
+	// Not all file systems support O_DIRECT (tmpfs, for example, does not), in
+	// which case Open returns an error.
+	Direct bool
+	// ReadOnly opens an existing file or device without write access, for
+	// inspecting a disk image. Writes panic, and Barrier does nothing.
+	ReadOnly bool
+}
+
+// Disk is a disk.Disk stored in a file or block device.
+type Disk struct {
+	fd        int
+	numBlocks uint64
+	direct    bool
+	readOnly  bool
+	bufs      *sync.Pool // block-aligned buffers for O_DIRECT I/O
+}
+
+var _ disk.Disk = (*Disk)(nil)
+
+// alignment for O_DIRECT buffers, which covers devices with logical block
+// sizes up to a full block
+const alignment = disk.BlockSize
+
+func alignedBlock() disk.Block {
+	b := make([]byte, disk.BlockSize+alignment)
+	off := uint64(uintptr(unsafe.Pointer(&b[0]))) % alignment
+	if off == 0 {
+		return b[:disk.BlockSize]
+	}
+	return b[alignment-off:][:disk.BlockSize]
+}
+
+// Open opens path as a disk of numBlocks blocks.
+//
+// A regular file is created if it does not exist and is extended to hold
+// numBlocks blocks (unless opts.ReadOnly is set). If numBlocks is 0 the disk
+// uses the existing size of the file or device.
+func Open(path string, numBlocks uint64, opts Opts) (*Disk, error) {
+	var flags = unix.O_RDWR | unix.O_CREAT | unix.O_CLOEXEC
+	if opts.ReadOnly {
+		flags = unix.O_RDONLY | unix.O_CLOEXEC
+	}
+	if opts.Direct {
+		if directFlag == 0 {
+			return nil, fmt.Errorf("filedisk: O_DIRECT is not supported on this platform")
+		}
+		flags |= directFlag
+	}
+	fd, err := unix.Open(path, flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("filedisk: open %s: %w", path, err)
+	}
+	d, err := setup(fd, numBlocks, opts)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("filedisk: %s: %w", path, err)
+	}
+	return d, nil
+}
+
+func setup(fd int, numBlocks uint64, opts Opts) (*Disk, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return nil, err
+	}
+	size, err := unix.Seek(fd, 0, unix.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	curBlocks := uint64(size) / disk.BlockSize
+	if numBlocks == 0 {
+		numBlocks = curBlocks
+	}
+	if numBlocks == 0 {
+		return nil, fmt.Errorf("empty disk")
+	}
+	if numBlocks > curBlocks {
+		if stat.Mode&unix.S_IFMT != unix.S_IFREG || opts.ReadOnly {
+			return nil, fmt.Errorf("device has %d blocks, need %d",
+				curBlocks, numBlocks)
+		}
+		if err := unix.Ftruncate(fd, int64(numBlocks*disk.BlockSize)); err != nil {
+			return nil, err
+		}
+		// make the new size durable
+		if err := unix.Fsync(fd); err != nil {
+			return nil, err
+		}
+	}
+	d := &Disk{
+		fd:        fd,
+		numBlocks: numBlocks,
+		direct:    opts.Direct,
+		readOnly:  opts.ReadOnly,
+	}
+	if d.direct {
+		d.bufs = &sync.Pool{
+			New: func() interface{} { return alignedBlock() },
+		}
+	}
+	return d, nil
+}
+
+func (d *Disk) checkAddr(op string, a uint64) {
+	if a >= d.numBlocks {
+		panic(fmt.Errorf("out-of-bounds %s at %v", op, a))
+	}
+}
+
+func (d *Disk) pread(b disk.Block, a uint64) {
+	n, err := unix.Pread(d.fd, b, int64(a*disk.BlockSize))
+	if err != nil {
+		panic("read failed: " + err.Error())
+	}
+	if uint64(n) != disk.BlockSize {
+		panic(fmt.Errorf("short read at %v (%d bytes)", a, n))
+	}
+}
+
+func (d *Disk) pwrite(b disk.Block, a uint64) error {
+	n, err := unix.Pwrite(d.fd, b, int64(a*disk.BlockSize))
+	if err != nil {
+		return fmt.Errorf("write failed at %v: %w", a, err)
+	}
+	if uint64(n) != disk.BlockSize {
+		return fmt.Errorf("short write at %v (%d bytes)", a, n)
+	}
+	return nil
+}
+
+func (d *Disk) ReadTo(a uint64, buf disk.Block) {
+	if uint64(len(buf)) != disk.BlockSize {
+		panic("buffer is not block-sized")
+	}
+	d.checkAddr("read", a)
+	if !d.direct {
+		d.pread(buf, a)
+		return
+	}
+	b := d.bufs.Get().(disk.Block)
+	d.pread(b, a)
+	copy(buf, b)
+	d.bufs.Put(b)
+}
+
+func (d *Disk) Read(a uint64) disk.Block {
+	buf := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, buf)
+	return buf
+}
+
+func (d *Disk) Write(a uint64, v disk.Block) {
+	if err := d.WriteErr(a, v); err != nil {
+		panic(err)
+	}
+}
+
+// WriteErr is like Write, but returns an error if the write fails or the disk
+// is read-only.
+//
+// Writing a buffer of the wrong size or past the end of the disk is a bug in
+// the caller and still panics.
+func (d *Disk) WriteErr(a uint64, v disk.Block) error {
+	if uint64(len(v)) != disk.BlockSize {
+		panic(fmt.Errorf("v is not block-sized (%d bytes)", len(v)))
+	}
+	d.checkAddr("write", a)
+	if d.readOnly {
+		return fmt.Errorf("write to read-only disk at %v", a)
+	}
+	if !d.direct {
+		return d.pwrite(v, a)
+	}
+	b := d.bufs.Get().(disk.Block)
+	copy(b, v)
+	err := d.pwrite(b, a)
+	d.bufs.Put(b)
+	return err
+}
+
+func (d *Disk) Size() uint64 {
+	return d.numBlocks
+}
+
+// Barrier makes all completed writes durable, including flushing the
+// device's volatile write cache.
+func (d *Disk) Barrier() {
+	if err := d.BarrierErr(); err != nil {
+		panic(err)
+	}
+}
+
+// BarrierErr is like Barrier, but returns an error if the flush fails (for
+// example, because the device could not write back an earlier write).
+func (d *Disk) BarrierErr() error {
+	if d.readOnly {
+		return nil
+	}
+	if err := flush(d.fd); err != nil {
+		return fmt.Errorf("flush failed: %w", err)
+	}
+	return nil
+}
+
+func (d *Disk) Close() {
+	if err := unix.Close(d.fd); err != nil {
+		panic(err)
+	}
+}
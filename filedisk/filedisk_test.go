@@ -0,0 +1,137 @@
+package filedisk_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/filedisk"
+	"github.com/mit-pdos/go-journal/txn"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+var _ wal.ErrorDisk = (*filedisk.Disk)(nil)
+
+func mkBlock(b byte) disk.Block {
+	block := make(disk.Block, disk.BlockSize)
+	for i := 0; i < 10; i++ {
+		block[i] = b
+	}
+	return block
+}
+
+// openDisk opens a fresh disk in a temporary directory, skipping the test if
+// the file system does not support the requested options.
+func openDisk(t *testing.T, opts filedisk.Opts) (string, *filedisk.Disk) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	d, err := filedisk.Open(path, 1000, opts)
+	if opts.Direct && errors.Is(err, unix.EINVAL) {
+		t.Skip("O_DIRECT not supported by the temporary directory")
+	}
+	require.NoError(t, err)
+	return path, d
+}
+
+func forEachOpts(t *testing.T, f func(t *testing.T, opts filedisk.Opts)) {
+	t.Run("buffered", func(t *testing.T) {
+		f(t, filedisk.Opts{})
+	})
+	t.Run("direct", func(t *testing.T) {
+		f(t, filedisk.Opts{Direct: true})
+	})
+}
+
+func TestReadWrite(t *testing.T) {
+	forEachOpts(t, func(t *testing.T, opts filedisk.Opts) {
+		assert := assert.New(t)
+		path, d := openDisk(t, opts)
+		assert.Equal(uint64(1000), d.Size())
+		d.Write(3, mkBlock(1))
+		d.Write(999, mkBlock(2))
+		d.Barrier()
+		assert.Equal(mkBlock(0), d.Read(2))
+		assert.Equal(mkBlock(1), d.Read(3))
+		buf := make(disk.Block, disk.BlockSize)
+		d.ReadTo(999, buf)
+		assert.Equal(mkBlock(2), buf)
+		d.Close()
+
+		d, err := filedisk.Open(path, 0, opts)
+		require.NoError(t, err)
+		assert.Equal(uint64(1000), d.Size(), "size should come from the file")
+		assert.Equal(mkBlock(1), d.Read(3))
+		assert.Panics(func() { d.Read(1000) })
+		d.Close()
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	path, d := openDisk(t, filedisk.Opts{})
+	d.Write(3, mkBlock(1))
+	d.Close()
+
+	d, err := filedisk.Open(path, 0, filedisk.Opts{ReadOnly: true})
+	require.NoError(t, err)
+	assert.Equal(mkBlock(1), d.Read(3))
+	assert.Panics(func() { d.Write(3, mkBlock(2)) })
+	assert.Error(d.WriteErr(3, mkBlock(2)))
+	assert.NoError(d.BarrierErr())
+	d.Barrier()
+	d.Close()
+
+	_, err = filedisk.Open(path, 2000, filedisk.Opts{ReadOnly: true})
+	assert.Error(err, "read-only disk cannot be extended")
+	_, err = filedisk.Open(filepath.Join(t.TempDir(), "missing.img"), 0,
+		filedisk.Opts{ReadOnly: true})
+	assert.Error(err, "read-only open should not create the file")
+}
+
+func TestWalRecovery(t *testing.T) {
+	forEachOpts(t, func(t *testing.T, opts filedisk.Opts) {
+		path, d := openDisk(t, opts)
+		l := wal.MkLog(d, wal.LOGSZ)
+		a := wal.LOGDISKBLOCKS + 10
+		pos, ok := l.MemAppend([]wal.Update{wal.MkBlockData(a, mkBlock(1))})
+		require.True(t, ok)
+		l.Flush(pos)
+		l.Shutdown()
+		d.Close()
+
+		d, err := filedisk.Open(path, 0, opts)
+		require.NoError(t, err)
+		l = wal.MkLog(d, wal.LOGSZ)
+		assert.Equal(t, mkBlock(1), l.Read(a))
+		l.Shutdown()
+		d.Close()
+	})
+}
+
+func TestTxnRecovery(t *testing.T) {
+	forEachOpts(t, func(t *testing.T, opts filedisk.Opts) {
+		path, d := openDisk(t, opts)
+		tsys := txn.Init(d)
+		a := addr.MkAddr(wal.LOGDISKBLOCKS+1, 0)
+		tx := txn.Begin(tsys)
+		tx.OverWrite(a, 8*disk.BlockSize, mkBlock(3))
+		require.True(t, tx.Commit(true))
+		tsys.Shutdown()
+		d.Close()
+
+		d, err := filedisk.Open(path, 0, opts)
+		require.NoError(t, err)
+		tsys = txn.Init(d)
+		tx = txn.Begin(tsys)
+		assert.Equal(t, mkBlock(3), tx.ReadBuf(a, 8*disk.BlockSize))
+		tx.ReleaseAll()
+		tsys.Shutdown()
+		d.Close()
+	})
+}
@@ -0,0 +1,13 @@
+package filedisk
+
+import "golang.org/x/sys/unix"
+
+// O_DIRECT does not exist on macOS
+const directFlag = 0
+
+// flush uses F_FULLFSYNC, since fsync on macOS does not flush the drive's
+// write cache.
+func flush(fd int) error {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_FULLFSYNC, 0)
+	return err
+}
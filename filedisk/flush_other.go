@@ -0,0 +1,11 @@
+//go:build unix && !linux && !darwin
+
+package filedisk
+
+import "golang.org/x/sys/unix"
+
+const directFlag = 0
+
+func flush(fd int) error {
+	return unix.Fsync(fd)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package filedisk
+
+// filedisk uses pread, pwrite and fsync on a file descriptor, which are only
+// available on unix systems; this reference makes the build fail with a
+// message saying so.
+var _ = filedisk_requires_a_unix_system
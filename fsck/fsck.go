@@ -0,0 +1,192 @@
+// Package fsck checks the on-disk state of a journal offline, and optionally
+// repairs it.
+//
+// Check decodes the log (see wal.Inspect) and reports problems that would
+// make recovery fail or misbehave: damaged or impossible headers, logged
+// blocks that would be installed over the journal itself or past the end of
+// the disk, a torn log tail that recovery will discard, and (given a
+// schema) logged blocks outside the schema's regions.
+//
+// Repair fixes the log either by replaying it, installing every block that
+// recovery would install and leaving the log empty, or by truncating it,
+// discarding everything that has not been installed yet. Neither may be used
+// while the journal is open.
+package fsck
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/schema"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+// Kind classifies a Problem.
+type Kind uint8
+
+const (
+	// BadHeader means a log header fails its checksum or the headers
+	// describe an impossible log, so recovery fails.
+	BadHeader Kind = iota
+	// BadAddr means a logged block has a home address inside the journal
+	// or past the end of the disk.
+	BadAddr
+	// TornLog means some logged blocks fail their checksums, so recovery
+	// will discard the end of the log.
+	TornLog
+	// BadSchema means a logged block is not in any region of the schema.
+	BadSchema
+)
+
+func (k Kind) String() string {
+	switch k {
+	case BadHeader:
+		return "bad header"
+	case BadAddr:
+		return "bad address"
+	case TornLog:
+		return "torn log"
+	case BadSchema:
+		return "schema violation"
+	}
+	return fmt.Sprintf("Kind(%d)", uint8(k))
+}
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Kind Kind
+	Pos  wal.LogPosition // log position involved, if any
+	Msg  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%v: %s", p.Kind, p.Msg)
+}
+
+// Report is the result of Check.
+type Report struct {
+	Log      *wal.LogInfo
+	Problems []Problem
+}
+
+// Clean reports whether Check found no problems.
+func (r *Report) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) add(kind Kind, pos wal.LogPosition, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{
+		Kind: kind,
+		Pos:  pos,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Check checks the journal on d, and if sch is non-nil, that its regions lie
+// in the data region of d and that every logged block is in one of them.
+//
+// Returns an error only if d does not hold a usable journal (see
+// wal.ReadSuperblock); everything else is reported as a Problem.
+func Check(d disk.Disk, sch *schema.Schema) (*Report, error) {
+	info, err := wal.Inspect(d)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{Log: info}
+	if info.HdrErr != nil {
+		r.add(BadHeader, 0, "%v", info.HdrErr)
+	}
+	dataStart := info.Super.DataStart
+	if sch != nil {
+		for _, reg := range sch.Regions() {
+			if reg.Start < dataStart || reg.End() > d.Size() {
+				r.add(BadSchema, 0, "%v is outside the data region [%d, %d)",
+					reg, dataStart, d.Size())
+			}
+		}
+	}
+	var torn = false
+	for _, e := range info.Entries {
+		if e.Addr < dataStart {
+			r.add(BadAddr, e.Pos, "pos %d logs block %d, inside the journal [0, %d)",
+				e.Pos, e.Addr, dataStart)
+		} else if e.Addr >= d.Size() {
+			r.add(BadAddr, e.Pos, "pos %d logs block %d, past the end of the disk (%d blocks)",
+				e.Pos, e.Addr, d.Size())
+		} else if sch != nil {
+			if _, ok := sch.Lookup(e.Addr); !ok {
+				r.add(BadSchema, e.Pos, "pos %d logs block %d, which is not in any region",
+					e.Pos, e.Addr)
+			}
+		}
+		if !e.ChecksumOK && !torn && info.HdrErr == nil {
+			torn = true
+			r.add(TornLog, e.Pos, "pos %d fails its checksum; recovery discards [%d, %d)",
+				e.Pos, info.ValidEnd, info.End)
+		}
+	}
+	return r, nil
+}
+
+// Mode is the way Repair fixes the log.
+type Mode uint8
+
+const (
+	// Replay installs the blocks recovery would install, then empties the
+	// log.
+	Replay Mode = iota
+	// Truncate empties the log without installing anything, discarding
+	// committed transactions that have not been installed yet.
+	Truncate
+)
+
+// ErrUnsafe is returned by Repair when replaying the log would write to the
+// wrong blocks or the log cannot be read.
+var ErrUnsafe = errors.New("fsck: cannot replay log")
+
+// Repair empties the log on d according to mode, so that recovery starts
+// from an empty log. The schema is not consulted.
+//
+// Replay refuses (with an error wrapping ErrUnsafe) to run if the headers are
+// damaged or a block it would install has a bad address; Truncate handles
+// these cases by discarding the log. Each step is followed by a barrier, so a
+// crash in the middle of Repair leaves a log that recovers to either the
+// original or the repaired state, and Repair can be run again.
+func Repair(d disk.Disk, mode Mode) error {
+	r, err := Check(d, nil)
+	if err != nil {
+		return err
+	}
+	info := r.Log
+	if mode == Truncate {
+		if info.HdrErr != nil {
+			// the decoded bounds are unreliable; start over at 0, as
+			// formatting does
+			wal.Truncate(d, 0)
+			wal.Advance(d, 0)
+			return nil
+		}
+		wal.Truncate(d, info.Start)
+		return nil
+	}
+	if info.HdrErr != nil {
+		return fmt.Errorf("%w: %v", ErrUnsafe, info.HdrErr)
+	}
+	for _, p := range r.Problems {
+		if p.Kind == BadAddr && p.Pos < info.ValidEnd {
+			return fmt.Errorf("%w: %s", ErrUnsafe, p.Msg)
+		}
+	}
+	// later positions overwrite earlier ones, as in recovery
+	for _, e := range info.Entries {
+		if e.Replayed {
+			d.Write(e.Addr, d.Read(e.LogBlock))
+		}
+	}
+	d.Barrier()
+	wal.Truncate(d, info.ValidEnd)
+	wal.Advance(d, info.ValidEnd)
+	return nil
+}
@@ -0,0 +1,186 @@
+package fsck_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/fsck"
+	"github.com/mit-pdos/go-journal/schema"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+const logSz = 16
+
+var dataStart = wal.LogDiskBlocks(logSz)
+
+// noInstallDisk drops the installer's writes (to the data region and to
+// LOGHDR2), so that everything logged stays in the on-disk log
+type noInstallDisk struct {
+	disk.Disk
+}
+
+func (d noInstallDisk) Write(a uint64, v disk.Block) {
+	if a == wal.LOGHDR2 || a >= dataStart {
+		return
+	}
+	d.Disk.Write(a, v)
+}
+
+// smallDisk hides the end of a disk
+type smallDisk struct {
+	disk.Disk
+	size uint64
+}
+
+func (d smallDisk) Size() uint64 {
+	return d.size
+}
+
+func mkBlock(b byte) disk.Block {
+	blk := make(disk.Block, disk.BlockSize)
+	blk[0] = b
+	return blk
+}
+
+// mkImage makes a disk whose log holds one transaction for each list of
+// addresses in txns, none of them installed
+func mkImage(t *testing.T, txns ...[]common.Bnum) disk.Disk {
+	d := disk.NewMemDisk(2000)
+	require.NoError(t, wal.Format(d, wal.FormatOpts{LogSz: logSz}))
+	l, err := wal.OpenLog(noInstallDisk{d}, logSz)
+	require.NoError(t, err)
+	var pos wal.LogPosition
+	for i, txn := range txns {
+		var upds []wal.Update
+		for _, a := range txn {
+			upds = append(upds, wal.MkBlockData(a, mkBlock(byte(i+1))))
+		}
+		var ok bool
+		pos, ok = l.MemAppend(upds)
+		require.True(t, ok)
+		// log each transaction separately
+		l.Flush(pos)
+	}
+	l.Shutdown()
+	return d
+}
+
+func kinds(r *fsck.Report) []fsck.Kind {
+	var ks []fsck.Kind
+	for _, p := range r.Problems {
+		ks = append(ks, p.Kind)
+	}
+	return ks
+}
+
+func TestCheckClean(t *testing.T) {
+	assert := assert.New(t)
+	d := mkImage(t, []common.Bnum{dataStart, dataStart + 1}, []common.Bnum{dataStart + 5})
+	r, err := fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.True(r.Clean(), "problems: %v", r.Problems)
+	assert.Equal(wal.LogPosition(0), r.Log.Start)
+	assert.Equal(wal.LogPosition(3), r.Log.End)
+	assert.Equal(r.Log.End, r.Log.ValidEnd)
+
+	_, err = fsck.Check(disk.NewMemDisk(100), nil)
+	assert.True(errors.Is(err, wal.ErrNotJournal))
+}
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+	d := mkImage(t, []common.Bnum{dataStart, dataStart + 1}, []common.Bnum{dataStart})
+	require.NoError(t, fsck.Repair(d, fsck.Replay))
+	assert.Equal(mkBlock(2), d.Read(dataStart), "later transaction wins")
+	assert.Equal(mkBlock(1), d.Read(dataStart+1))
+
+	r, err := fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.True(r.Clean())
+	assert.Equal(r.Log.Start, r.Log.End, "log should be empty")
+}
+
+func TestTornLog(t *testing.T) {
+	assert := assert.New(t)
+	d := mkImage(t, []common.Bnum{dataStart}, []common.Bnum{dataStart + 1, dataStart + 2})
+	// damage the second block of the second transaction
+	b := d.Read(wal.LogDiskBlocks(logSz) - logSz + 2)
+	b[100] ^= 0xff
+	d.Write(wal.LogDiskBlocks(logSz)-logSz+2, b)
+
+	r, err := fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.Equal([]fsck.Kind{fsck.TornLog}, kinds(r))
+	assert.Equal(wal.LogPosition(2), r.Problems[0].Pos)
+	assert.Equal(wal.LogPosition(1), r.Log.ValidEnd)
+
+	require.NoError(t, fsck.Repair(d, fsck.Replay))
+	assert.Equal(mkBlock(1), d.Read(dataStart))
+	assert.Equal(mkBlock(0), d.Read(dataStart+1), "torn txn should not be replayed")
+	r, err = fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.True(r.Clean(), "problems: %v", r.Problems)
+}
+
+func TestBadAddr(t *testing.T) {
+	assert := assert.New(t)
+	d := smallDisk{Disk: mkImage(t, []common.Bnum{1500}), size: 1000}
+	r, err := fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.Equal([]fsck.Kind{fsck.BadAddr}, kinds(r))
+
+	err = fsck.Repair(d, fsck.Replay)
+	assert.True(errors.Is(err, fsck.ErrUnsafe), "got %v", err)
+	require.NoError(t, fsck.Repair(d, fsck.Truncate))
+	r, err = fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.True(r.Clean())
+}
+
+func TestCheckSchema(t *testing.T) {
+	assert := assert.New(t)
+	d := mkImage(t, []common.Bnum{dataStart, dataStart + 100})
+	sch := schema.MustNew(schema.Region{
+		Name: "inodes", Start: dataStart, Len: 10, ObjSz: 1024,
+	})
+	r, err := fsck.Check(d, sch)
+	require.NoError(t, err)
+	assert.Equal([]fsck.Kind{fsck.BadSchema}, kinds(r))
+	assert.Equal(wal.LogPosition(1), r.Problems[0].Pos)
+
+	sch = schema.MustNew(schema.Region{
+		Name: "all", Start: 0, Len: 2000, ObjSz: 1,
+	})
+	r, err = fsck.Check(d, sch)
+	require.NoError(t, err)
+	assert.Equal([]fsck.Kind{fsck.BadSchema}, kinds(r),
+		"region overlapping the journal")
+}
+
+func TestBadHeader(t *testing.T) {
+	assert := assert.New(t)
+	d := mkImage(t, []common.Bnum{dataStart})
+	b := d.Read(wal.LOGHDR)
+	b[100] ^= 0xff
+	d.Write(wal.LOGHDR, b)
+
+	r, err := fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.Equal([]fsck.Kind{fsck.BadHeader}, kinds(r))
+	err = fsck.Repair(d, fsck.Replay)
+	assert.True(errors.Is(err, fsck.ErrUnsafe), "got %v", err)
+
+	require.NoError(t, fsck.Repair(d, fsck.Truncate))
+	r, err = fsck.Check(d, nil)
+	require.NoError(t, err)
+	assert.True(r.Clean(), "problems: %v", r.Problems)
+	l, err := wal.OpenLog(d, logSz)
+	require.NoError(t, err, "repaired log should recover")
+	assert.Equal(mkBlock(0), l.Read(dataStart), "truncated txn is discarded")
+	l.Shutdown()
+}
@@ -6,12 +6,12 @@ require (
 	github.com/goose-lang/primitive v0.1.0
 	github.com/stretchr/testify v1.9.0
 	github.com/tchajed/marshal v0.6.2
+	golang.org/x/sys v0.22.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/goose-lang/std v0.4.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
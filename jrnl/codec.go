@@ -0,0 +1,38 @@
+package jrnl
+
+import (
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/codec"
+)
+
+func checkObj[T any](op *Op, a addr.Addr, sz uint64) error {
+	if err := codec.Check[T](a, sz); err != nil {
+		return err
+	}
+	return op.CheckObj(a, sz)
+}
+
+// ReadObj reads the object of size sz at a in op and decodes it as a T (see
+// package codec for the supported types).
+//
+// Returns an error if a T does not encode to exactly sz bits (codec.ErrSize)
+// or the object does not match the schema (schema.ErrSchema).
+func ReadObj[T any](op *Op, a addr.Addr, sz uint64) (T, error) {
+	if err := checkObj[T](op, a, sz); err != nil {
+		var v T
+		return v, err
+	}
+	return codec.Decode[T](op.ReadBuf(a, sz).Data, sz)
+}
+
+// WriteObj encodes v and writes it to the object of size sz at a in op.
+func WriteObj[T any](op *Op, a addr.Addr, sz uint64, v T) error {
+	if err := checkObj[T](op, a, sz); err != nil {
+		return err
+	}
+	data, err := codec.Encode(v, sz)
+	if err != nil {
+		return err
+	}
+	return op.OverWriteErr(a, sz, data)
+}
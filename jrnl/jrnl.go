@@ -18,8 +18,9 @@
 // CommitWait, which results in an "unstable" operation. An unstable operation is
 // made visible atomically to other threads, including across crashes, but if the
 // system crashes the latest unstable operations can be lost. To guarantee that a
-// particular operation is durable, call Flush on the underlying *obj.Log (which
-// flushes all transactions).
+// particular operation is durable, commit it with CommitWithHandle and Wait on
+// the handle, or call Flush on the underlying *obj.Log (which flushes all
+// transactions).
 //
 // Objects have sizes. Implicit in the code is that there is a static "schema"
 // that determines the disk layout: each block has objects of a particular size,
@@ -29,10 +30,17 @@
 //
 // A file system can realize this schema fairly simply, since the disk is
 // partitioned into inodes, data blocks, and bitmap allocators for each (sized
-// appropriately), all allocated statically.
+// appropriately), all allocated statically. The schema can also be made
+// explicit with package schema and obj.Log.SetSchema, in which case every
+// object accessed is checked against it.
 package jrnl
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/goose-lang/primitive/disk"
+
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/obj"
@@ -40,19 +48,29 @@ import (
 )
 
 // LogBlocks is the maximum number of blocks that can be written in one
-// operation
+// operation on a log of the default size (see Op.LogBlocks for the actual
+// limit); logs with larger capacities can be formatted with wal.Format.
 const LogBlocks uint64 = 511
 
-// LogBytes is the maximum size of an operation, in bytes
+// LogBytes is the maximum size of an operation on a log of the default size,
+// in bytes
 const LogBytes uint64 = 4096 * 511
 
+var (
+	// ErrSizeMismatch is returned when an operation writes an object with a
+	// different size than it previously accessed at the same address.
+	ErrSizeMismatch = errors.New("jrnl: object size mismatch")
+	// ErrAborted is returned when committing an aborted operation.
+	ErrAborted = errors.New("jrnl: operation aborted")
+)
+
 // Op is an in-progress journal operation.
 //
-// Call CommitWait to persist the operation's writes.
-// To abort the operation simply stop using it.
+// Call CommitWait to persist the operation's writes, or Abort to discard them.
 type Op struct {
-	log  *obj.Log
-	bufs *buf.BufMap // map of bufs read/written by this operation
+	log     *obj.Log
+	bufs    *buf.BufMap // map of bufs read/written by this operation
+	aborted bool
 }
 
 // Begin starts a local journal operation with no writes from a global object
@@ -66,7 +84,32 @@ func Begin(log *obj.Log) *Op {
 	return trans
 }
 
+func (op *Op) checkNotAborted() {
+	if op.aborted {
+		panic("jrnl: use of aborted operation")
+	}
+}
+
+// CheckObj checks the object of size sz at addr against the log's schema (see
+// obj.Log.SetSchema), returning an error wrapping schema.ErrSchema if it does
+// not match.
+func (op *Op) CheckObj(addr addr.Addr, sz uint64) error {
+	return op.log.CheckObj(addr, sz)
+}
+
+func (op *Op) mustCheckObj(addr addr.Addr, sz uint64) {
+	err := op.CheckObj(addr, sz)
+	if err != nil {
+		panic(fmt.Errorf("jrnl: %w", err))
+	}
+}
+
+// ReadBuf reads the object of size sz at addr
+//
+// Panics if the object does not match the log's schema.
 func (op *Op) ReadBuf(addr addr.Addr, sz uint64) *buf.Buf {
+	op.checkNotAborted()
+	op.mustCheckObj(addr, sz)
 	b := op.bufs.Lookup(addr)
 	if b == nil {
 		buf := op.log.Load(addr, sz)
@@ -77,7 +120,25 @@ func (op *Op) ReadBuf(addr addr.Addr, sz uint64) *buf.Buf {
 }
 
 // OverWrite writes an object to addr
+//
+// Panics if the object does not match the log's schema, or if the operation
+// already accessed an object of a different size at addr.
 func (op *Op) OverWrite(addr addr.Addr, sz uint64, data []byte) {
+	err := op.OverWriteErr(addr, sz, data)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// OverWriteErr is like OverWrite, but returns an error instead of panicking
+// if the object does not match the log's schema (schema.ErrSchema) or the
+// operation already accessed an object of a different size at addr
+// (ErrSizeMismatch). The operation is unchanged on error.
+func (op *Op) OverWriteErr(addr addr.Addr, sz uint64, data []byte) error {
+	op.checkNotAborted()
+	if err := op.CheckObj(addr, sz); err != nil {
+		return fmt.Errorf("jrnl: %w", err)
+	}
 	var b = op.bufs.Lookup(addr)
 	if b == nil {
 		b = buf.MkBuf(addr, sz, data)
@@ -85,11 +146,24 @@ func (op *Op) OverWrite(addr addr.Addr, sz uint64, data []byte) {
 		op.bufs.Insert(b)
 	} else {
 		if sz != b.Sz {
-			panic("overwrite")
+			return fmt.Errorf("%w: %d-bit object at block %d offset %d "+
+				"was previously accessed with size %d",
+				ErrSizeMismatch, sz, addr.Blkno, addr.Off, b.Sz)
 		}
 		b.Data = data
 		b.SetDirty()
 	}
+	return nil
+}
+
+// LogBlocks is the maximum number of blocks that this operation can write.
+func (op *Op) LogBlocks() uint64 {
+	return op.log.LogSz()
+}
+
+// LogBytes is the maximum size of this operation, in bytes.
+func (op *Op) LogBytes() uint64 {
+	return disk.BlockSize * op.log.LogSz()
 }
 
 // NDirty reports an upper bound on the size of this transaction when committed.
@@ -111,8 +185,38 @@ func (op *Op) NDirty() uint64 {
 //
 // wait=false is an asynchronous commit, which can be made durable later with
 // Flush.
+//
+// An aborted operation cannot be committed and CommitWait returns false.
 func (op *Op) CommitWait(wait bool) bool {
-	util.DPrintf(3, "Commit %p w %v\n", op, wait)
-	ok := op.log.CommitWait(op.bufs.DirtyBufs(), wait)
+	_, ok := op.CommitWithHandle(wait)
 	return ok
 }
+
+// CommitWithHandle is like CommitWait, but also returns a handle that tracks
+// when the operation becomes durable, so that after an asynchronous commit the
+// caller can wait for this particular operation.
+func (op *Op) CommitWithHandle(wait bool) (obj.CommitHandle, bool) {
+	h, err := op.CommitErr(wait)
+	return h, err == nil
+}
+
+// CommitErr is like CommitWithHandle, but returns an error explaining why the
+// commit failed: ErrAborted, or an error from obj.Log.CommitErr such as
+// wal.ErrTxnTooLarge.
+func (op *Op) CommitErr(wait bool) (obj.CommitHandle, error) {
+	if op.aborted {
+		return obj.CommitHandle{}, ErrAborted
+	}
+	util.DPrintf(3, "Commit %p w %v\n", op, wait)
+	return op.log.CommitErr(op.bufs.DirtyBufs(), wait)
+}
+
+// Abort discards the operation's buffered reads and writes.
+//
+// After Abort, ReadBuf and OverWrite panic and CommitWait fails. Aborting an
+// operation more than once has no further effect.
+func (op *Op) Abort() {
+	util.DPrintf(3, "Abort %p\n", op)
+	op.bufs = buf.MkBufMap()
+	op.aborted = true
+}
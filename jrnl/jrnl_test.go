@@ -7,6 +7,7 @@ import (
 
 	"github.com/goose-lang/primitive/disk"
 	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/crashdisk"
 	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/obj"
 	"github.com/mit-pdos/go-journal/util"
@@ -19,6 +20,23 @@ func TestSizeConstants(t *testing.T) {
 	assert.Equal(t, disk.BlockSize*wal.LOGSZ, jrnl.LogBytes)
 }
 
+func TestLogSize(t *testing.T) {
+	d := disk.NewMemDisk(10000)
+	log := obj.MkLogSz(d, 1024)
+	op := jrnl.Begin(log)
+	assert.Equal(t, uint64(1024), op.LogBlocks())
+	assert.Equal(t, disk.BlockSize*1024, op.LogBytes())
+
+	// a transaction bigger than the default log
+	start := wal.LogDiskBlocks(1024)
+	for i := uint64(0); i < 600; i++ {
+		op.OverWrite(addr.MkAddr(start+i, 0), 8*disk.BlockSize,
+			make([]byte, disk.BlockSize))
+	}
+	assert.True(t, op.CommitWait(true), "large operation should commit")
+	log.Shutdown()
+}
+
 func data(sz int) []byte {
 	d := make([]byte, sz)
 	rand.Read(d)
@@ -27,8 +45,11 @@ func data(sz int) []byte {
 
 const inodeSz uint64 = 8 * 128
 
+// dataStart is the first block after a default-sized log
+const dataStart = wal.LOGDISKBLOCKS
+
 func inodeAddr(i uint64) addr.Addr {
-	return addr.MkAddr(513+i/32, (i%32)*inodeSz)
+	return addr.MkAddr(dataStart+i/32, (i%32)*inodeSz)
 }
 
 func TestJrnlWriteRead(t *testing.T) {
@@ -83,6 +104,56 @@ func TestJrnlReadSetDirty(t *testing.T) {
 	assertObj(t, bs1, op, inodeAddr(1))
 }
 
+func TestJrnlErrors(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	log := obj.MkLog(d)
+
+	op := jrnl.Begin(log)
+	op.OverWrite(inodeAddr(0), inodeSz, data(128))
+	err := op.OverWriteErr(inodeAddr(0), inodeSz/2, data(64))
+	assert.ErrorIs(err, jrnl.ErrSizeMismatch)
+	assert.Panics(func() { op.OverWrite(inodeAddr(0), inodeSz/2, data(64)) })
+	_, err = op.CommitErr(true)
+	assert.NoError(err, "failed overwrite should not affect the operation")
+
+	op = jrnl.Begin(log)
+	for i := uint64(0); i <= log.LogSz(); i++ {
+		op.OverWrite(addr.MkAddr(dataStart+i, 0), 8*disk.BlockSize,
+			make([]byte, disk.BlockSize))
+	}
+	_, err = op.CommitErr(true)
+	assert.ErrorIs(err, wal.ErrTxnTooLarge)
+
+	op = jrnl.Begin(log)
+	op.Abort()
+	_, err = op.CommitErr(true)
+	assert.ErrorIs(err, jrnl.ErrAborted)
+
+	log.Shutdown()
+	op = jrnl.Begin(log)
+	op.OverWrite(inodeAddr(1), inodeSz, data(128))
+	_, err = op.CommitErr(false)
+	assert.ErrorIs(err, wal.ErrLogShutdown)
+}
+
+func TestJrnlAbort(t *testing.T) {
+	d := disk.NewMemDisk(10000)
+	log := obj.MkLog(d)
+
+	op := jrnl.Begin(log)
+	op.OverWrite(inodeAddr(0), inodeSz, data(128))
+	op.Abort()
+	assert.Equal(t, uint64(0), op.NDirty(), "abort should drop writes")
+	assert.False(t, op.CommitWait(true), "aborted operation should not commit")
+	assert.Panics(t, func() { op.ReadBuf(inodeAddr(0), inodeSz) })
+
+	op = jrnl.Begin(log)
+	assertObj(t, make([]byte, 128), op, inodeAddr(0),
+		"aborted write should have no effect")
+	log.Shutdown()
+}
+
 func testJrnlConcurrentOperations(t *testing.T, wait bool) {
 	d := disk.NewMemDisk(10000)
 	log := obj.MkLog(d)
@@ -113,6 +184,93 @@ func testJrnlConcurrentOperations(t *testing.T, wait bool) {
 	}
 }
 
+func TestJrnlPackedBits(t *testing.T) {
+	d := disk.NewMemDisk(10000)
+	log := obj.MkLog(d)
+
+	// two adjacent 12-bit counters, the second straddling a byte boundary
+	c0 := addr.MkAddr(dataStart, 0)
+	c1 := addr.MkAddr(dataStart, 12)
+	op := jrnl.Begin(log)
+	op.OverWrite(c0, 12, []byte{0xFF, 0x0F})
+	assert.True(t, op.CommitWait(true))
+	op = jrnl.Begin(log)
+	op.OverWrite(c1, 12, []byte{0x50, 0xAA})
+	assert.True(t, op.CommitWait(true))
+
+	op = jrnl.Begin(log)
+	// objects are loaded with the whole bytes they occupy, so c0 and c1 both
+	// see the byte they share
+	b0 := op.ReadBuf(c0, 12).Data
+	assert.Equal(t, []byte{0xFF, 0x5F}, b0)
+	b1 := op.ReadBuf(c1, 12).Data
+	assert.Equal(t, []byte{0x5F, 0xAA}, b1)
+	log.Shutdown()
+}
+
+func TestCommitHandle(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	log := obj.MkLog(d)
+
+	op1 := jrnl.Begin(log)
+	bs := data(128)
+	op1.OverWrite(inodeAddr(0), inodeSz, bs)
+	h1, ok := op1.CommitWithHandle(false)
+	assert.True(ok)
+
+	op2 := jrnl.Begin(log)
+	op2.OverWrite(inodeAddr(32), inodeSz, data(128))
+	h2, ok := op2.CommitWithHandle(false)
+	assert.True(ok)
+	assert.Less(h1.Pos(), h2.Pos())
+
+	h1.Wait()
+	assert.True(h1.Durable())
+
+	op3 := jrnl.Begin(log)
+	op3.ReadBuf(inodeAddr(0), inodeSz)
+	h3, ok := op3.CommitWithHandle(false)
+	assert.True(ok)
+	assert.True(h3.Durable(), "read-only operation is trivially durable")
+	h3.Wait()
+
+	log.Shutdown()
+	log = obj.MkLog(d)
+	op := jrnl.Begin(log)
+	assert.Equal(bs, op.ReadBuf(inodeAddr(0), inodeSz).Data,
+		"waited-for operation should survive a restart")
+	log.Shutdown()
+}
+
+func TestFlushAfterFailedCommit(t *testing.T) {
+	assert := assert.New(t)
+	d := crashdisk.New(disk.NewMemDisk(10000))
+	log := obj.MkLog(d)
+
+	op := jrnl.Begin(log)
+	bs := data(128)
+	op.OverWrite(inodeAddr(0), inodeSz, bs)
+	assert.True(op.CommitWait(false))
+
+	// a failed commit should not make Flush forget about pos
+	op = jrnl.Begin(log)
+	for i := uint64(0); i <= log.LogSz(); i++ {
+		op.OverWrite(addr.MkAddr(dataStart+i, 0), 8*disk.BlockSize,
+			make([]byte, disk.BlockSize))
+	}
+	assert.False(op.CommitWait(false),
+		"operation larger than the log should fail")
+	log.Flush()
+
+	d.Crash()
+	log.Shutdown()
+	log = obj.MkLog(d.CrashState(func(int) bool { return false }))
+	op = jrnl.Begin(log)
+	assertObj(t, bs, op, inodeAddr(0), "flushed operation was lost")
+	log.Shutdown()
+}
+
 func TestConcurrent(t *testing.T) {
 	t.Run("synchronous", func(t *testing.T) {
 		testJrnlConcurrentOperations(t, true)
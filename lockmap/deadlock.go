@@ -0,0 +1,105 @@
+package lockmap
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDeadlock is returned when acquiring a lock would complete a cycle of
+// owners waiting for each other.
+var ErrDeadlock = errors.New("lockmap: deadlock")
+
+// waitGraph tracks which owners hold each lock and which lock each owner is
+// waiting for. Owners wait for at most one lock at a time, but a lock held in
+// shared mode can have several holders, so finding a cycle requires a search
+// over all of them.
+//
+// The graph is protected by its own mutex, which is always acquired after a
+// shard's mutex.
+type waitGraph struct {
+	mu      *sync.Mutex
+	holders map[uint64]map[uint64]bool // lock -> owners
+	waiting map[uint64]uint64          // owner -> lock
+}
+
+func mkWaitGraph() *waitGraph {
+	return &waitGraph{
+		mu:      new(sync.Mutex),
+		holders: make(map[uint64]map[uint64]bool),
+		waiting: make(map[uint64]uint64),
+	}
+}
+
+func (g *waitGraph) addHolder(addr uint64, owner uint64) {
+	g.mu.Lock()
+	hs, ok := g.holders[addr]
+	if !ok {
+		hs = make(map[uint64]bool)
+		g.holders[addr] = hs
+	}
+	hs[owner] = true
+	g.mu.Unlock()
+}
+
+func (g *waitGraph) removeHolder(addr uint64, owner uint64) {
+	g.mu.Lock()
+	hs := g.holders[addr]
+	delete(hs, owner)
+	if len(hs) == 0 {
+		delete(g.holders, addr)
+	}
+	g.mu.Unlock()
+}
+
+func (g *waitGraph) clearHolders(addr uint64) {
+	g.mu.Lock()
+	delete(g.holders, addr)
+	g.mu.Unlock()
+}
+
+// reaches reports whether waiter, waiting for addr, transitively waits for
+// target.
+//
+// An owner upgrading its own shared lock is among the holders it waits for;
+// such self-edges are skipped.
+//
+// Assumes caller holds mu.
+func (g *waitGraph) reaches(waiter uint64, addr uint64, target uint64, visited map[uint64]bool) bool {
+	for h := range g.holders[addr] {
+		if h == waiter {
+			continue
+		}
+		if h == target {
+			return true
+		}
+		if visited[h] {
+			continue
+		}
+		visited[h] = true
+		next, ok := g.waiting[h]
+		if ok && g.reaches(h, next, target, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// startWait records that owner is about to wait for addr, unless doing so
+// would create a cycle.
+func (g *waitGraph) startWait(owner uint64, addr uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reaches(owner, addr, owner, make(map[uint64]bool)) {
+		return fmt.Errorf("%w: owner %d waiting for lock %d", ErrDeadlock,
+			owner, addr)
+	}
+	g.waiting[owner] = addr
+	return nil
+}
+
+func (g *waitGraph) endWait(owner uint64) {
+	g.mu.Lock()
+	delete(g.waiting, owner)
+	g.mu.Unlock()
+}
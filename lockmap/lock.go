@@ -10,64 +10,248 @@
 // responsible for maintaining the lock state of all a such that a % NSHARDS = i.
 // Acquiring a lock requires synchronizing with any threads accessing the same
 // shard.
+//
+// Each lock is a reader-writer lock: Acquire takes it in exclusive mode, while
+// AcquireShared takes it in shared mode, which any number of holders can hold
+// at once as long as nobody holds it exclusively. A shared holder can Upgrade
+// to exclusive mode; since two holders upgrading the same lock would wait for
+// each other forever, the second one fails with ErrDeadlock instead. Waiting
+// writers do not hold off new readers, so a steady stream of readers can starve
+// a writer.
+//
+// Waiting for a lock can be bounded with AcquireContext, or avoided entirely
+// with TryAcquire.
+//
+// A LockMap created with MkLockMapWithDetection also detects deadlocks: locks
+// acquired with AcquireOwner record their owner, and an acquire that would wait
+// in a cycle of owners fails with ErrDeadlock instead of blocking forever.
 package lockmap
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
+)
+
+// Mode is the way a lock is acquired.
+type Mode uint8
+
+const (
+	// Exclusive excludes all other holders.
+	Exclusive Mode = iota
+	// Shared excludes only exclusive holders.
+	Shared
+	// Upgrade converts a shared lock held by the caller into an exclusive
+	// lock.
+	Upgrade
 )
 
 type lockState struct {
-	held    bool
-	cond    *sync.Cond
-	waiters uint64
+	held    bool   // held in exclusive mode
+	readers uint64 // number of shared holders
+	// owners among the shared holders (the other readers acquired the lock
+	// without an owner); nil if there are none
+	sharers   map[uint64]bool
+	upgrading bool // a shared holder is waiting to upgrade
+	cond      *sync.Cond
+	waiters   uint64
+}
+
+// canAcquire reports whether the lock can be acquired in mode right now
+func (state *lockState) canAcquire(mode Mode) bool {
+	if state.held {
+		return false
+	}
+	if mode == Shared {
+		return true
+	}
+	if mode == Upgrade {
+		// the caller must be the only reader
+		return state.readers == 1
+	}
+	return state.readers == 0
+}
+
+// take acquires the lock in mode on behalf of owner, assuming canAcquire(mode)
+func (state *lockState) take(mode Mode, owner uint64) {
+	if mode == Shared {
+		state.readers += 1
+		if owner != 0 {
+			if state.sharers == nil {
+				state.sharers = make(map[uint64]bool)
+			}
+			state.sharers[owner] = true
+		}
+		return
+	}
+	if mode == Upgrade {
+		state.readers -= 1
+		delete(state.sharers, owner)
+	}
+	state.held = true
+}
+
+// holdsShared reports whether owner holds the lock in shared mode; for owner 0,
+// whether some reader without an owner holds it
+func (state *lockState) holdsShared(owner uint64) bool {
+	if owner != 0 {
+		return state.sharers[owner]
+	}
+	return state.readers > uint64(len(state.sharers))
+}
+
+func (state *lockState) free() bool {
+	return !state.held && state.readers == 0
 }
 
 type lockShard struct {
 	mu    *sync.Mutex
 	state map[uint64]*lockState
+	stats *Stats // shared by all shards
 }
 
-func mkLockShard() *lockShard {
+func mkLockShard(stats *Stats) *lockShard {
 	state := make(map[uint64]*lockState)
 	mu := new(sync.Mutex)
 	a := &lockShard{
 		mu:    mu,
 		state: state,
+		stats: stats,
 	}
 	return a
 }
 
-func (lmap *lockShard) acquire(addr uint64) {
+// getState returns the state of addr, allocating it if addr has none
+//
+// Assumes caller holds mu.
+func (lmap *lockShard) getState(addr uint64) *lockState {
+	var state *lockState
+	state1, ok1 := lmap.state[addr]
+	if ok1 {
+		state = state1
+	} else {
+		// Allocate a new state
+		state = &lockState{
+			held:    false,
+			readers: 0,
+			cond:    sync.NewCond(lmap.mu),
+			waiters: 0,
+		}
+		lmap.state[addr] = state
+	}
+	return state
+}
+
+// acquire acquires addr in mode on behalf of owner
+//
+// If g is non-nil and owner is nonzero, records owner in g and fails rather
+// than waiting in a cycle. If ctx is done before the lock is acquired, gives up
+// and returns ctx.Err().
+func (lmap *lockShard) acquire(ctx context.Context, addr uint64, owner uint64, mode Mode, g *waitGraph) error {
+	waitStart, err := lmap.acquireWait(ctx, addr, owner, mode, g)
+	if !waitStart.IsZero() {
+		lmap.stats.Contended.Inc()
+		lmap.stats.WaitLatency.ObserveSince(waitStart)
+	}
+	if err == nil {
+		lmap.stats.Acquires.Inc()
+	} else if errors.Is(err, ErrDeadlock) {
+		lmap.stats.Deadlocks.Inc()
+	} else {
+		lmap.stats.Canceled.Inc()
+	}
+	return err
+}
+
+// acquireWait implements acquire, also returning when it started waiting (or
+// the zero time if it did not wait)
+func (lmap *lockShard) acquireWait(ctx context.Context, addr uint64, owner uint64, mode Mode, g *waitGraph) (time.Time, error) {
+	var waitStart time.Time
+	// whether this thread set state.upgrading
+	var upgrading = false
 	lmap.mu.Lock()
-	for {
-		var state *lockState
-		state1, ok1 := lmap.state[addr]
-		if ok1 {
-			state = state1
-		} else {
-			// Allocate a new state
-			state = &lockState{
-				held:    false,
-				cond:    sync.NewCond(lmap.mu),
-				waiters: 0,
-			}
-			lmap.state[addr] = state
+	if mode == Upgrade {
+		state, ok := lmap.state[addr]
+		if !ok || !state.holdsShared(owner) {
+			lmap.mu.Unlock()
+			panic("lockmap: upgrade of a lock not held in shared mode")
 		}
+	}
+	for {
+		state := lmap.getState(addr)
 
 		var acquired bool
 
-		if !state.held {
-			state.held = true
+		if state.canAcquire(mode) {
+			state.take(mode, owner)
 			acquired = true
+			if upgrading {
+				state.upgrading = false
+			}
+			if g != nil && owner != 0 {
+				g.addHolder(addr, owner)
+			}
 		} else {
+			if err := ctx.Err(); err != nil {
+				if upgrading {
+					state.upgrading = false
+				}
+				lmap.mu.Unlock()
+				return waitStart, err
+			}
+			if mode == Upgrade && !upgrading {
+				if state.upgrading {
+					// the other upgrader waits for this thread to release
+					// its shared lock, and vice versa
+					lmap.mu.Unlock()
+					return waitStart, fmt.Errorf("%w: concurrent upgrades of lock %d",
+						ErrDeadlock, addr)
+				}
+				state.upgrading = true
+				upgrading = true
+			}
+			if g != nil && owner != 0 {
+				err := g.startWait(owner, addr)
+				if err != nil {
+					if upgrading {
+						state.upgrading = false
+					}
+					lmap.mu.Unlock()
+					return waitStart, err
+				}
+			}
+			if waitStart.IsZero() {
+				waitStart = time.Now()
+			}
 			state.waiters += 1
+			// wake up this waiter (and any others, which will just wait
+			// again) if ctx is canceled
+			stop := context.AfterFunc(ctx, func() {
+				lmap.mu.Lock()
+				state.cond.Broadcast()
+				lmap.mu.Unlock()
+			})
 			state.cond.Wait()
+			stop()
+			if g != nil && owner != 0 {
+				g.endWait(owner)
+			}
 
 			state2, ok2 := lmap.state[addr]
 			if ok2 {
 				// Should always be true, but we don't need to prove this
 				state2.waiters -= 1
 			}
+			if err := ctx.Err(); err != nil {
+				if upgrading {
+					state.upgrading = false
+				}
+				lmap.abandon(addr)
+				lmap.mu.Unlock()
+				return waitStart, err
+			}
 		}
 
 		if acquired {
@@ -76,15 +260,67 @@ func (lmap *lockShard) acquire(addr uint64) {
 		continue
 	}
 	lmap.mu.Unlock()
+	return waitStart, nil
 }
 
-func (lmap *lockShard) release(addr uint64) {
+// abandon cleans up after a waiter for addr gives up, deleting the lock state
+// if the lock is free and nobody else is waiting for it (as release would
+// have).
+//
+// Releases wake up all waiters, so the abandoning waiter cannot have consumed a
+// wakeup meant for someone else.
+//
+// Assumes caller holds mu.
+func (lmap *lockShard) abandon(addr uint64) {
+	state, ok := lmap.state[addr]
+	if ok && state.free() && state.waiters == 0 {
+		delete(lmap.state, addr)
+	}
+}
+
+// tryAcquire acquires addr in mode only if that does not require waiting
+func (lmap *lockShard) tryAcquire(addr uint64, mode Mode) bool {
+	lmap.mu.Lock()
+	state := lmap.getState(addr)
+	if !state.canAcquire(mode) {
+		lmap.mu.Unlock()
+		return false
+	}
+	state.take(mode, 0)
+	lmap.mu.Unlock()
+	lmap.stats.Acquires.Inc()
+	return true
+}
+
+// release releases addr, in whichever mode owner holds it
+func (lmap *lockShard) release(addr uint64, owner uint64, g *waitGraph) {
 	lmap.mu.Lock()
 	state := lmap.state[addr]
-	state.held = false
-	if state.waiters > 0 {
-		state.cond.Signal()
+	if state.held {
+		state.held = false
+		if g != nil {
+			// an exclusive lock has only one holder, whatever owner says
+			g.clearHolders(addr)
+		}
 	} else {
+		if !state.holdsShared(owner) {
+			lmap.mu.Unlock()
+			if owner == 0 {
+				panic("lockmap: Release of a shared lock held by owners; use ReleaseOwner")
+			}
+			panic("lockmap: ReleaseOwner by an owner that does not hold the lock")
+		}
+		state.readers -= 1
+		delete(state.sharers, owner)
+		if g != nil && owner != 0 {
+			g.removeHolder(addr, owner)
+		}
+	}
+	if state.waiters > 0 {
+		// several shared waiters might now be able to proceed, or an
+		// upgrading reader might be waiting for the last other reader
+		state.cond.Broadcast()
+	} else if state.free() {
 		delete(lmap.state, addr)
 	}
 	lmap.mu.Unlock()
@@ -94,25 +330,120 @@ const NSHARD uint64 = 65537
 
 type LockMap struct {
 	shards []*lockShard
+	graph  *waitGraph // nil if deadlock detection is disabled
+	stats  *Stats
 }
 
 func MkLockMap() *LockMap {
+	stats := new(Stats)
 	var shards []*lockShard
 	for i := uint64(0); i < NSHARD; i++ {
-		shards = append(shards, mkLockShard())
+		shards = append(shards, mkLockShard(stats))
 	}
 	a := &LockMap{
 		shards: shards,
+		stats:  stats,
 	}
 	return a
 }
 
+// MkLockMapWithDetection makes a LockMap that detects deadlocks between
+// owners (see AcquireOwner).
+func MkLockMapWithDetection() *LockMap {
+	lmap := MkLockMap()
+	lmap.graph = mkWaitGraph()
+	return lmap
+}
+
 func (lmap *LockMap) Acquire(flataddr uint64) {
 	shard := lmap.shards[flataddr%NSHARD]
-	shard.acquire(flataddr)
+	shard.acquire(context.Background(), flataddr, 0, Exclusive, nil)
+}
+
+// AcquireShared acquires flataddr in shared mode, which other callers of
+// AcquireShared can hold at the same time.
+func (lmap *LockMap) AcquireShared(flataddr uint64) {
+	shard := lmap.shards[flataddr%NSHARD]
+	shard.acquire(context.Background(), flataddr, 0, Shared, nil)
 }
 
+// Upgrade converts the caller's shared lock on flataddr (acquired with
+// AcquireShared) into an exclusive lock, waiting for the other shared holders
+// to release it.
+//
+// If another holder is already waiting to upgrade the same lock, neither
+// could make progress, so Upgrade returns an error wrapping ErrDeadlock and
+// the caller still holds its shared lock. Upgrade panics if the lock is not
+// held in shared mode; AcquireMode can also check that the caller is one of
+// the holders.
+func (lmap *LockMap) Upgrade(flataddr uint64) error {
+	shard := lmap.shards[flataddr%NSHARD]
+	return shard.acquire(context.Background(), flataddr, 0, Upgrade, nil)
+}
+
+// AcquireContext acquires flataddr, unless ctx is done first, in which case it
+// returns ctx.Err() without acquiring the lock.
+func (lmap *LockMap) AcquireContext(ctx context.Context, flataddr uint64) error {
+	shard := lmap.shards[flataddr%NSHARD]
+	return shard.acquire(ctx, flataddr, 0, Exclusive, nil)
+}
+
+// TryAcquire acquires flataddr if it is free and reports whether it did so,
+// without waiting.
+func (lmap *LockMap) TryAcquire(flataddr uint64) bool {
+	shard := lmap.shards[flataddr%NSHARD]
+	return shard.tryAcquire(flataddr, Exclusive)
+}
+
+// TryAcquireShared is like TryAcquire, but acquires flataddr in shared mode.
+func (lmap *LockMap) TryAcquireShared(flataddr uint64) bool {
+	shard := lmap.shards[flataddr%NSHARD]
+	return shard.tryAcquire(flataddr, Shared)
+}
+
+// AcquireOwner acquires flataddr on behalf of owner, a nonzero identifier
+// for the thread or transaction that will hold the lock.
+//
+// If deadlock detection is enabled and waiting for flataddr would complete a
+// cycle (owner waits for a lock held by an owner that, transitively, waits
+// for a lock held by owner), AcquireOwner returns an error wrapping
+// ErrDeadlock without acquiring the lock. The caller should then release its
+// locks (for example, by aborting its transaction) and retry.
+func (lmap *LockMap) AcquireOwner(flataddr uint64, owner uint64) error {
+	return lmap.AcquireOwnerContext(context.Background(), flataddr, owner)
+}
+
+// AcquireOwnerContext combines AcquireOwner and AcquireContext: it fails with
+// ErrDeadlock if waiting would deadlock and with ctx.Err() if ctx is done
+// before the lock is acquired.
+func (lmap *LockMap) AcquireOwnerContext(ctx context.Context, flataddr uint64, owner uint64) error {
+	return lmap.AcquireMode(ctx, flataddr, owner, Exclusive)
+}
+
+// AcquireMode is the most general way to acquire a lock: it acquires flataddr
+// in mode on behalf of owner, with the same errors as AcquireOwnerContext.
+//
+// Upgrade requires owner to hold the lock in shared mode, and panics
+// otherwise. Deadlock detection accounts for shared holders, so an owner that
+// upgrades while another holder waits for one of its locks is detected as a
+// deadlock.
+func (lmap *LockMap) AcquireMode(ctx context.Context, flataddr uint64, owner uint64, mode Mode) error {
+	shard := lmap.shards[flataddr%NSHARD]
+	return shard.acquire(ctx, flataddr, owner, mode, lmap.graph)
+}
+
+// Release releases flataddr. A shared lock acquired with an owner must be
+// released with ReleaseOwner instead; Release panics if all the shared holders
+// have owners.
 func (lmap *LockMap) Release(flataddr uint64) {
 	shard := lmap.shards[flataddr%NSHARD]
-	shard.release(flataddr)
+	shard.release(flataddr, 0, lmap.graph)
+}
+
+// ReleaseOwner releases the lock on flataddr held by owner, in whichever mode
+// it was acquired. Shared locks acquired with an owner must be released this
+// way, so that deadlock detection knows which of the holders left.
+func (lmap *LockMap) ReleaseOwner(flataddr uint64, owner uint64) {
+	shard := lmap.shards[flataddr%NSHARD]
+	shard.release(flataddr, owner, lmap.graph)
 }
@@ -0,0 +1,316 @@
+package lockmap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitUntilWaiting polls until owner is waiting for a lock in g
+func waitUntilWaiting(g *waitGraph, owner uint64) {
+	for {
+		g.mu.Lock()
+		_, ok := g.waiting[owner]
+		g.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	lmap := MkLockMap()
+	lmap.Acquire(1)
+	lmap.Acquire(1 + NSHARD)
+	done := make(chan bool)
+	go func() {
+		lmap.Acquire(1)
+		done <- true
+	}()
+	lmap.Release(1)
+	<-done
+	lmap.Release(1)
+	lmap.Release(1 + NSHARD)
+}
+
+func TestDeadlockDetection(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMapWithDetection()
+	assert.NoError(lmap.AcquireOwner(1, 1))
+	assert.NoError(lmap.AcquireOwner(2, 2))
+
+	done := make(chan error)
+	go func() {
+		done <- lmap.AcquireOwner(2, 1)
+	}()
+	waitUntilWaiting(lmap.graph, 1)
+
+	err := lmap.AcquireOwner(1, 2)
+	assert.True(errors.Is(err, ErrDeadlock), "expected deadlock, got %v", err)
+
+	// owner 2 gives up its lock, so owner 1 can proceed
+	lmap.Release(2)
+	assert.NoError(<-done)
+	lmap.Release(1)
+	lmap.Release(2)
+}
+
+func TestDeadlockCycleOfThree(t *testing.T) {
+	lmap := MkLockMapWithDetection()
+	for owner := uint64(1); owner <= 3; owner++ {
+		assert.NoError(t, lmap.AcquireOwner(owner, owner))
+	}
+	done := make(chan error, 2)
+	go func() { done <- lmap.AcquireOwner(2, 1) }()
+	waitUntilWaiting(lmap.graph, 1)
+	go func() { done <- lmap.AcquireOwner(3, 2) }()
+	waitUntilWaiting(lmap.graph, 2)
+
+	err := lmap.AcquireOwner(1, 3)
+	assert.True(t, errors.Is(err, ErrDeadlock))
+	lmap.Release(3)
+	assert.NoError(t, <-done)
+	lmap.Release(2)
+	assert.NoError(t, <-done)
+}
+
+func TestNoDetectionWithoutOwner(t *testing.T) {
+	lmap := MkLockMapWithDetection()
+	lmap.Acquire(1)
+	assert.NoError(t, lmap.AcquireOwner(2, 1))
+	lmap.Release(1)
+	lmap.Release(2)
+	assert.Empty(t, lmap.graph.holders)
+	assert.Empty(t, lmap.graph.waiting)
+}
+
+func TestTryAcquire(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMap()
+	assert.True(lmap.TryAcquire(1))
+	assert.False(lmap.TryAcquire(1), "lock is already held")
+	lmap.Release(1)
+	assert.True(lmap.TryAcquire(1))
+	lmap.Release(1)
+}
+
+func hasState(lmap *LockMap, addr uint64) bool {
+	shard := lmap.shards[addr%NSHARD]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	_, ok := shard.state[addr]
+	return ok
+}
+
+func numWaiters(lmap *LockMap, addr uint64) uint64 {
+	shard := lmap.shards[addr%NSHARD]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.state[addr].waiters
+}
+
+func TestAcquireContextTimeout(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMap()
+	lmap.Acquire(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := lmap.AcquireContext(ctx, 1)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	assert.Equal(uint64(0), numWaiters(lmap, 1),
+		"canceled waiter should be removed")
+	lmap.Release(1)
+	assert.False(hasState(lmap, 1), "lock state should be freed")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(lmap.AcquireContext(canceled, 1),
+		"free lock should be acquired even with a canceled context")
+	lmap.Release(1)
+}
+
+func TestAcquireContextPassesWakeup(t *testing.T) {
+	lmap := MkLockMap()
+	lmap.Acquire(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		canceled <- lmap.AcquireContext(ctx, 1)
+	}()
+	acquired := make(chan bool)
+	go func() {
+		lmap.Acquire(1)
+		acquired <- true
+	}()
+	for numWaiters(lmap, 1) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// the release's wakeup may go to the canceled waiter, which must pass it
+	// on
+	lmap.Release(1)
+	cancel()
+	err := <-canceled
+	if err == nil {
+		// the canceled waiter acquired the lock before noticing
+		lmap.Release(1)
+	}
+	<-acquired
+	lmap.Release(1)
+}
+
+func TestSharedLocks(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMap()
+	lmap.AcquireShared(1)
+	lmap.AcquireShared(1)
+	assert.True(lmap.TryAcquireShared(1))
+	assert.False(lmap.TryAcquire(1), "shared lock excludes writers")
+	lmap.Release(1)
+	lmap.Release(1)
+	assert.False(lmap.TryAcquire(1))
+	lmap.Release(1)
+	assert.False(hasState(lmap, 1))
+
+	lmap.Acquire(1)
+	assert.False(lmap.TryAcquireShared(1), "exclusive lock excludes readers")
+	lmap.Release(1)
+}
+
+func TestSharedWakesAllReaders(t *testing.T) {
+	lmap := MkLockMap()
+	lmap.Acquire(1)
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			lmap.AcquireShared(1)
+			done <- true
+		}()
+	}
+	for numWaiters(lmap, 1) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	lmap.Release(1)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	for i := 0; i < 3; i++ {
+		lmap.Release(1)
+	}
+	assert.False(t, hasState(lmap, 1))
+}
+
+func TestUpgrade(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMap()
+	lmap.AcquireShared(1)
+	assert.NoError(lmap.Upgrade(1))
+	assert.False(lmap.TryAcquireShared(1), "upgraded lock is exclusive")
+	lmap.Release(1)
+
+	lmap.AcquireShared(1)
+	lmap.AcquireShared(1)
+	upgraded := make(chan bool)
+	go func() {
+		assert.NoError(lmap.Upgrade(1))
+		upgraded <- true
+	}()
+	for numWaiters(lmap, 1) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// the other reader leaves
+	lmap.Release(1)
+	<-upgraded
+	lmap.Release(1)
+	assert.False(hasState(lmap, 1))
+}
+
+func TestConcurrentUpgrade(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMap()
+	lmap.AcquireShared(1)
+	lmap.AcquireShared(1)
+	done := make(chan error)
+	go func() {
+		done <- lmap.Upgrade(1)
+	}()
+	for numWaiters(lmap, 1) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// without deadlock detection, the second upgrader still fails rather
+	// than waiting forever
+	err := lmap.Upgrade(1)
+	assert.True(errors.Is(err, ErrDeadlock), "expected deadlock, got %v", err)
+	lmap.Release(1)
+	assert.NoError(<-done)
+	lmap.Release(1)
+	assert.False(hasState(lmap, 1))
+}
+
+func TestUpgradeNotHeld(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMapWithDetection()
+	ctx := context.Background()
+	assert.Panics(func() { lmap.Upgrade(1) })
+	assert.NoError(lmap.AcquireMode(ctx, 1, 1, Shared))
+	assert.Panics(func() { lmap.AcquireMode(ctx, 1, 2, Upgrade) },
+		"owner 2 does not hold the lock")
+	assert.Panics(func() { lmap.Upgrade(1) }, "the only reader has an owner")
+	assert.Panics(func() { lmap.Release(1) }, "owned shared lock needs ReleaseOwner")
+	lmap.ReleaseOwner(1, 1)
+	assert.False(hasState(lmap, 1))
+	assert.Empty(lmap.graph.holders)
+}
+
+func TestUpgradeDeadlock(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMapWithDetection()
+	ctx := context.Background()
+	assert.NoError(lmap.AcquireMode(ctx, 1, 1, Shared))
+	assert.NoError(lmap.AcquireMode(ctx, 1, 2, Shared))
+
+	done := make(chan error)
+	go func() {
+		done <- lmap.AcquireMode(ctx, 1, 1, Upgrade)
+	}()
+	waitUntilWaiting(lmap.graph, 1)
+
+	err := lmap.AcquireMode(ctx, 1, 2, Upgrade)
+	assert.True(errors.Is(err, ErrDeadlock), "expected deadlock, got %v", err)
+	lmap.ReleaseOwner(1, 2)
+	assert.NoError(<-done)
+	lmap.ReleaseOwner(1, 1)
+	assert.Empty(lmap.graph.holders)
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	lmap := MkLockMapWithDetection()
+	assert.NoError(lmap.AcquireOwner(1, 1))
+	assert.NoError(lmap.AcquireOwner(2, 2))
+	assert.False(lmap.TryAcquire(1))
+
+	done := make(chan error)
+	go func() {
+		done <- lmap.AcquireOwner(2, 1)
+	}()
+	waitUntilWaiting(lmap.graph, 1)
+	assert.ErrorIs(lmap.AcquireOwner(1, 2), ErrDeadlock)
+	lmap.Release(2)
+	assert.NoError(<-done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Error(lmap.AcquireContext(ctx, 1))
+
+	s := lmap.Stats()
+	assert.Equal(uint64(3), s.Acquires.Load())
+	assert.Equal(uint64(2), s.Contended.Load(), "owner 1 and the timed-out acquire waited")
+	assert.Equal(uint64(2), s.WaitLatency.Snapshot().Count)
+	assert.Equal(uint64(1), s.Deadlocks.Load())
+	assert.Equal(uint64(1), s.Canceled.Load())
+}
@@ -0,0 +1,35 @@
+package lockmap
+
+import (
+	"github.com/mit-pdos/go-journal/stats"
+)
+
+// Stats are statistics about lock contention in a LockMap.
+type Stats struct {
+	Acquires  stats.Counter // locks acquired, in any mode
+	Contended stats.Counter // acquires that had to wait for another holder
+	// WaitLatency is the time contended acquires spent waiting, in
+	// microseconds (whether or not they eventually acquired the lock)
+	WaitLatency stats.Histogram
+	Deadlocks   stats.Counter // acquires that failed with ErrDeadlock
+	Canceled    stats.Counter // acquires abandoned because their context was done
+}
+
+// Stats returns the live statistics of lmap.
+func (lmap *LockMap) Stats() *Stats {
+	return lmap.stats
+}
+
+// WriteMetrics writes s with metric names prefixed by go_journal_lockmap.
+func (s *Stats) WriteMetrics(w *stats.Writer) {
+	w.Counter("go_journal_lockmap_acquires_total",
+		"Locks acquired.", s.Acquires.Load())
+	w.Counter("go_journal_lockmap_contended_total",
+		"Lock acquires that had to wait.", s.Contended.Load())
+	w.Histogram("go_journal_lockmap_wait_seconds",
+		"Time spent waiting for contended locks.", &s.WaitLatency, 1e-6)
+	w.Counter("go_journal_lockmap_deadlocks_total",
+		"Lock acquires that failed because they would deadlock.", s.Deadlocks.Load())
+	w.Counter("go_journal_lockmap_canceled_total",
+		"Lock acquires abandoned because their context was done.", s.Canceled.Load())
+}
@@ -9,32 +9,94 @@ import (
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/schema"
 	"github.com/mit-pdos/go-journal/util"
 	"github.com/mit-pdos/go-journal/wal"
 
 	"sync"
+	"time"
 )
 
 // Log mediates access to object loading and installation.
 //
 // There is only one Log object.
 type Log struct {
-	mu  *sync.Mutex
-	log *wal.Walog
-	pos wal.LogPosition // highest un-flushed log position
+	mu     *sync.Mutex
+	log    *wal.Walog
+	pos    wal.LogPosition // position of the latest successful commit
+	schema *schema.Schema  // nil if objects are not checked
+	stats  *Stats
+}
+
+func mkLog(walog *wal.Walog) *Log {
+	return &Log{
+		mu:    new(sync.Mutex),
+		log:   walog,
+		pos:   wal.LogPosition(0),
+		stats: &Stats{Wal: walog.Stats()},
+	}
 }
 
 // MkLog recovers the object logging system
-// (or initializes from an all-zero disk).
+// (or initializes from an all-zero disk with a log of wal.LOGSZ blocks).
 func MkLog(d disk.Disk) *Log {
-	log := &Log{
-		mu:  new(sync.Mutex),
-		log: wal.MkLog(d),
-		pos: wal.LogPosition(0),
+	return MkLogSz(d, wal.LOGSZ)
+}
+
+// MkLogSz is like MkLog, but initializes an all-zero disk with a log of logSz
+// blocks.
+//
+// An existing log keeps the size it was created with.
+func MkLogSz(d disk.Disk, logSz uint64) *Log {
+	log, err := OpenLog(d, logSz)
+	if err != nil {
+		panic(err)
 	}
 	return log
 }
 
+// OpenLog is like MkLogSz, but returns an error rather than panicking if the
+// disk does not hold a usable journal (see wal.OpenLog).
+func OpenLog(d disk.Disk, logSz uint64) (*Log, error) {
+	walog, err := wal.OpenLog(d, logSz)
+	if err != nil {
+		return nil, err
+	}
+	return mkLog(walog), nil
+}
+
+// OpenLogReadOnly opens the journal on d without ever writing to it (see
+// wal.OpenLogReadOnly). Loads see the recovered state, and every commit with
+// writes fails with wal.ErrReadOnly.
+func OpenLogReadOnly(d disk.Disk) (*Log, error) {
+	walog, err := wal.OpenLogReadOnly(d)
+	if err != nil {
+		return nil, err
+	}
+	return mkLog(walog), nil
+}
+
+// SetSchema makes CheckObj check objects against s. It should be called
+// before the log is used.
+func (l *Log) SetSchema(s *schema.Schema) {
+	l.schema = s
+}
+
+// Schema returns the schema objects are checked against, or nil if there is
+// none.
+func (l *Log) Schema() *schema.Schema {
+	return l.schema
+}
+
+// CheckObj checks the object of size sz at addr against the log's schema, if
+// it has one.
+func (l *Log) CheckObj(addr addr.Addr, sz uint64) error {
+	if l.schema == nil {
+		return nil
+	}
+	return l.schema.Check(addr, sz)
+}
+
 // Read a disk object into buf
 func (l *Log) Load(addr addr.Addr, sz uint64) *buf.Buf {
 	blk := l.log.Read(addr.Blkno)
@@ -78,54 +140,164 @@ func (l *Log) installBufs(bufs []*buf.Buf) []wal.Update {
 
 // Acquires the commit log, installs the buffers into their
 // blocks, and appends the blocks to the in-memory log.
-func (l *Log) doCommit(bufs []*buf.Buf) (wal.LogPosition, bool) {
+func (l *Log) doCommit(bufs []*buf.Buf) (wal.LogPosition, error) {
 	l.mu.Lock()
 
 	blks := l.installBufs(bufs)
 
 	util.DPrintf(3, "doCommit: %v bufs\n", len(blks))
 
-	n, ok := l.log.MemAppend(blks)
-	// FIXME: should only be set if ok
-	l.pos = n
+	n, err := l.log.MemAppendErr(blks)
+	if err == nil {
+		l.pos = n
+		l.stats.CommitBlocks.Observe(uint64(len(blks)))
+	}
 
 	l.mu.Unlock()
 
-	return n, ok
+	return n, err
 }
 
-// Commit dirty bufs of the transaction into the log, and perhaps wait.
-func (l *Log) CommitWait(bufs []*buf.Buf, wait bool) bool {
-	var commit = true
-	if len(bufs) > 0 {
-		n, ok := l.doCommit(bufs)
-		if !ok {
-			util.DPrintf(10, "memappend failed; log is too small\n")
-			commit = false
-		} else {
-			if wait {
-				l.log.Flush(n)
-			}
-		}
-	} else {
+// CommitHandle identifies a committed transaction, so that the caller can
+// later learn when it is durable.
+//
+// The zero CommitHandle stands for a transaction with no writes, which is
+// always durable.
+type CommitHandle struct {
+	log *Log
+	pos wal.LogPosition
+}
+
+// Pos returns the log position the transaction ends at.
+func (h CommitHandle) Pos() wal.LogPosition {
+	return h.pos
+}
+
+// Durable reports whether the transaction is durable, without waiting.
+func (h CommitHandle) Durable() bool {
+	if h.log == nil {
+		return true
+	}
+	return h.log.log.IsDurable(h.pos)
+}
+
+// Wait makes the transaction durable (along with the transactions committed
+// before it) and waits until it is.
+//
+// Wait returns early, with the transaction possibly not durable, if the disk
+// fails or the log is shut down first; use WaitErr to find out.
+func (h CommitHandle) Wait() {
+	if h.log == nil {
+		return
+	}
+	h.log.FlushTo(h.pos)
+}
+
+// WaitErr is like Wait, but returns an error if the transaction did not become
+// durable (see FlushToErr).
+func (h CommitHandle) WaitErr() error {
+	if h.log == nil {
+		return nil
+	}
+	return h.log.FlushToErr(h.pos)
+}
+
+// CommitWait commits dirty bufs of the transaction into the log, and perhaps
+// waits for them to be durable.
+//
+// On success, returns the log position of the commit, which can be passed to
+// FlushTo to make the transaction durable later. A transaction with no writes
+// commits at position 0, which is always durable.
+func (l *Log) CommitWait(bufs []*buf.Buf, wait bool) (wal.LogPosition, bool) {
+	h, err := l.CommitErr(bufs, wait)
+	return h.pos, err == nil
+}
+
+// CommitWithHandle is like CommitWait, but returns a handle for waiting on or
+// polling the transaction's durability.
+func (l *Log) CommitWithHandle(bufs []*buf.Buf, wait bool) (CommitHandle, bool) {
+	h, err := l.CommitErr(bufs, wait)
+	return h, err == nil
+}
+
+// CommitErr is like CommitWithHandle, but returns an error explaining why a
+// commit failed (see wal.Walog.MemAppendErr): wal.ErrTxnTooLarge,
+// wal.ErrOverflow, wal.ErrLogShutdown, or wal.ErrIO if the disk failed.
+//
+// With wait, a disk failure while flushing is also reported (wrapping
+// wal.ErrIO), along with the handle: the transaction was committed in memory
+// but is not durable.
+func (l *Log) CommitErr(bufs []*buf.Buf, wait bool) (CommitHandle, error) {
+	if len(bufs) == 0 {
 		util.DPrintf(5, "commit read-only trans\n")
+		l.stats.ReadOnlyCommits.Inc()
+		return CommitHandle{}, nil
+	}
+	start := time.Now()
+	h, err := l.commit(bufs, wait)
+	if err != nil {
+		l.stats.FailedCommits.Inc()
+	} else {
+		l.stats.Commits.Inc()
+	}
+	l.stats.CommitLatency.ObserveSince(start)
+	return h, err
+}
+
+func (l *Log) commit(bufs []*buf.Buf, wait bool) (CommitHandle, error) {
+	n, err := l.doCommit(bufs)
+	if err != nil {
+		util.DPrintf(10, "memappend failed: %v\n", err)
+		return CommitHandle{}, err
 	}
-	return commit
+	h := CommitHandle{log: l, pos: n}
+	if wait {
+		return h, l.FlushToErr(n)
+	}
+	return h, nil
 }
 
-// NOTE: this is coarse-grained and unattached to the transaction ID
+// FlushTo makes the transaction committed at pos durable, along with the
+// transactions committed before it.
+//
+// Unlike Flush, FlushTo does not wait for transactions committed after pos by
+// other threads (though group commit may make some of them durable at the
+// same time). Like wal.Walog.Flush, it returns early if the disk fails or the
+// log is shut down.
+func (l *Log) FlushTo(pos wal.LogPosition) {
+	l.log.Flush(pos)
+}
+
+// FlushToErr is like FlushTo, but reports whether pos became durable: it
+// returns an error wrapping wal.ErrIO if the disk failed first, or
+// wal.ErrLogShutdown if the log was shut down first (see wal.Walog.FlushErr).
+func (l *Log) FlushToErr(pos wal.LogPosition) error {
+	return l.log.FlushErr(pos)
+}
+
+// Flush makes every transaction committed so far durable, returning false if
+// the disk fails or the log is shut down first.
+//
+// NOTE: this is coarse-grained and unattached to the transaction ID; use
+// FlushTo to wait for a particular transaction.
 func (l *Log) Flush() bool {
 	l.mu.Lock()
 	pos := l.pos
 	l.mu.Unlock()
 
-	l.log.Flush(pos)
-	return true
+	return l.FlushToErr(pos) == nil
+}
+
+// Checkpoint makes every committed transaction durable and installs it in
+// the data region, emptying the on-disk log (see wal.Walog.Checkpoint).
+func (l *Log) Checkpoint() error {
+	return l.log.Checkpoint()
 }
 
-// LogSz returns 511 (the size of the wal log)
+// LogSz returns the size of the wal log, the maximum number of blocks a
+// transaction can write.
 func (l *Log) LogSz() uint64 {
-	return wal.LOGSZ
+	return l.log.LogSz()
 }
 
 func (l *Log) Shutdown() {
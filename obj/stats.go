@@ -0,0 +1,42 @@
+package obj
+
+import (
+	"github.com/mit-pdos/go-journal/stats"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+// Stats are statistics about commits to a Log.
+type Stats struct {
+	Commits         stats.Counter // successful commits with writes
+	ReadOnlyCommits stats.Counter // commits without writes, which do nothing
+	FailedCommits   stats.Counter
+	// CommitBlocks is the number of blocks written by each commit, after
+	// combining the objects written to the same block
+	CommitBlocks stats.Histogram
+	// CommitLatency is the time taken by commits with writes, in
+	// microseconds, including waiting for them to be durable if requested
+	CommitLatency stats.Histogram
+
+	Wal *wal.Stats // statistics of the underlying write-ahead log
+}
+
+// Stats returns the live statistics of l.
+func (l *Log) Stats() *Stats {
+	return l.stats
+}
+
+// WriteMetrics writes s, and the statistics of the write-ahead log, with
+// metric names prefixed by go_journal_obj and go_journal_wal.
+func (s *Stats) WriteMetrics(w *stats.Writer) {
+	w.Counter("go_journal_obj_commits_total",
+		"Commits with writes.", s.Commits.Load())
+	w.Counter("go_journal_obj_readonly_commits_total",
+		"Commits without writes.", s.ReadOnlyCommits.Load())
+	w.Counter("go_journal_obj_failed_commits_total",
+		"Commits that failed.", s.FailedCommits.Load())
+	w.Histogram("go_journal_obj_commit_blocks",
+		"Blocks written by each commit.", &s.CommitBlocks, 1)
+	w.Histogram("go_journal_obj_commit_seconds",
+		"Time taken by commits with writes.", &s.CommitLatency, 1e-6)
+	s.Wal.WriteMetrics(w)
+}
@@ -0,0 +1,111 @@
+// Package schema describes the static layout of objects on a journaled disk.
+//
+// The journal assumes (see package jrnl) that every block holds objects of a
+// single size, fixed by the disk layout, so that objects never overlap. A
+// Schema makes this layout explicit: it divides the disk into named regions of
+// blocks, each with an object size, and checks that every object accessed
+// matches the region it falls in.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+)
+
+// ErrSchema is wrapped by all errors for objects that do not match the schema.
+var ErrSchema = errors.New("schema violation")
+
+// Region is a range of blocks that hold objects of a single size.
+type Region struct {
+	Name  string
+	Start common.Bnum // first block
+	Len   uint64      // number of blocks
+	ObjSz uint64      // object size, in bits
+}
+
+// End returns the block just past r.
+func (r Region) End() common.Bnum {
+	return r.Start + r.Len
+}
+
+func (r Region) String() string {
+	return fmt.Sprintf("region %q (blocks [%d, %d), %d-bit objects)",
+		r.Name, r.Start, r.End(), r.ObjSz)
+}
+
+// Schema is an immutable set of non-overlapping regions.
+type Schema struct {
+	regions []Region // sorted by Start
+}
+
+// New creates a schema from regions, which can be given in any order.
+//
+// Returns an error if regions overlap or an object size does not fit in a
+// block.
+func New(regions ...Region) (*Schema, error) {
+	rs := append([]Region(nil), regions...)
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Start < rs[j].Start })
+	for i, r := range rs {
+		if r.Len == 0 {
+			return nil, fmt.Errorf("schema: %v is empty", r)
+		}
+		if r.ObjSz == 0 || r.ObjSz > common.NBITBLOCK {
+			return nil, fmt.Errorf("schema: %v has an invalid object size", r)
+		}
+		if i > 0 && rs[i-1].End() > r.Start {
+			return nil, fmt.Errorf("schema: %v overlaps %v", rs[i-1], r)
+		}
+	}
+	return &Schema{regions: rs}, nil
+}
+
+// MustNew is like New, but panics on error, for schemas fixed in code.
+func MustNew(regions ...Region) *Schema {
+	s, err := New(regions...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Regions returns the regions of s, sorted by starting block.
+func (s *Schema) Regions() []Region {
+	return append([]Region(nil), s.regions...)
+}
+
+// Lookup returns the region containing block bn.
+func (s *Schema) Lookup(bn common.Bnum) (Region, bool) {
+	i := sort.Search(len(s.regions), func(i int) bool {
+		return s.regions[i].End() > bn
+	})
+	if i < len(s.regions) && s.regions[i].Start <= bn {
+		return s.regions[i], true
+	}
+	return Region{}, false
+}
+
+// Check checks that the object of sz bits at a is an object of the region
+// containing it: it must have the region's object size and start at a multiple
+// of that size.
+//
+// The errors wrap ErrSchema and name the offending region.
+func (s *Schema) Check(a addr.Addr, sz uint64) error {
+	r, ok := s.Lookup(a.Blkno)
+	if !ok {
+		return fmt.Errorf("%w: block %d is not in any region", ErrSchema,
+			a.Blkno)
+	}
+	if sz != r.ObjSz {
+		return fmt.Errorf("%w: %d-bit object at block %d offset %d in %v",
+			ErrSchema, sz, a.Blkno, a.Off, r)
+	}
+	if a.Off%r.ObjSz != 0 || a.Off+r.ObjSz > common.NBITBLOCK {
+		return fmt.Errorf("%w: misaligned object at block %d offset %d in %v",
+			ErrSchema, a.Blkno, a.Off, r)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package schema
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+)
+
+func testSchema() *Schema {
+	return MustNew(
+		Region{Name: "data", Start: 600, Len: 1000, ObjSz: common.NBITBLOCK},
+		Region{Name: "inodes", Start: 513, Len: 10, ObjSz: 8 * common.INODESZ},
+		Region{Name: "bitmap", Start: 523, Len: 1, ObjSz: 1},
+	)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(
+		Region{Name: "a", Start: 10, Len: 10, ObjSz: 8},
+		Region{Name: "b", Start: 15, Len: 10, ObjSz: 8},
+	)
+	assert.Error(t, err, "overlapping regions")
+	_, err = New(Region{Name: "a", Start: 10, Len: 1, ObjSz: 0})
+	assert.Error(t, err)
+	_, err = New(Region{Name: "a", Start: 10, Len: 0, ObjSz: 8})
+	assert.Error(t, err)
+
+	s := testSchema()
+	rs := s.Regions()
+	assert.Equal(t, []string{"inodes", "bitmap", "data"},
+		[]string{rs[0].Name, rs[1].Name, rs[2].Name})
+}
+
+func TestLookup(t *testing.T) {
+	assert := assert.New(t)
+	s := testSchema()
+	r, ok := s.Lookup(513)
+	assert.True(ok)
+	assert.Equal("inodes", r.Name)
+	r, ok = s.Lookup(522)
+	assert.True(ok)
+	assert.Equal("inodes", r.Name)
+	r, ok = s.Lookup(1599)
+	assert.True(ok)
+	assert.Equal("data", r.Name)
+	_, ok = s.Lookup(524)
+	assert.False(ok, "gap between regions")
+	_, ok = s.Lookup(1600)
+	assert.False(ok)
+	_, ok = s.Lookup(0)
+	assert.False(ok)
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	s := testSchema()
+	inodeSz := 8 * common.INODESZ
+	assert.NoError(s.Check(addr.MkAddr(514, 3*inodeSz), inodeSz))
+	assert.NoError(s.Check(addr.MkAddr(523, 17), 1))
+	assert.NoError(s.Check(addr.MkAddr(700, 0), common.NBITBLOCK))
+
+	err := s.Check(addr.MkAddr(514, 0), common.NBITBLOCK)
+	assert.True(errors.Is(err, ErrSchema))
+	assert.True(strings.Contains(err.Error(), `"inodes"`),
+		"error should name the region: %v", err)
+
+	err = s.Check(addr.MkAddr(514, 8), inodeSz)
+	assert.True(errors.Is(err, ErrSchema), "misaligned inode")
+	err = s.Check(addr.MkAddr(2000, 0), common.NBITBLOCK)
+	assert.True(errors.Is(err, ErrSchema), "block outside schema")
+}
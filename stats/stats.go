@@ -0,0 +1,177 @@
+// Package stats provides the counters and histograms that the journal layers
+// use to report statistics, and exports them in the Prometheus text format.
+//
+// Counters and histograms are updated with atomic operations, so recording a
+// statistic never takes a lock, and they can be read while they are being
+// updated. A snapshot of several statistics is not atomic as a whole.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a count that only goes up.
+type Counter struct {
+	v uint64
+}
+
+// Add adds n to the count.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Inc adds one to the count.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Load returns the current count.
+func (c *Counter) Load() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// NBUCKETS is the number of buckets in a Histogram. Bucket 0 counts values up
+// to 1, bucket i counts values in (2^(i-1), 2^i], and the last bucket also
+// counts everything larger.
+const NBUCKETS = 32
+
+// Histogram is a distribution of values, such as sizes or latencies (in
+// microseconds, see ObserveSince), in power-of-two buckets.
+type Histogram struct {
+	buckets [NBUCKETS]uint64
+	count   uint64
+	sum     uint64
+}
+
+func bucketOf(v uint64) int {
+	if v == 0 {
+		return 0
+	}
+	// the smallest b such that v <= 2^b
+	b := bits.Len64(v - 1)
+	if b >= NBUCKETS {
+		return NBUCKETS - 1
+	}
+	return b
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v uint64) {
+	atomic.AddUint64(&h.buckets[bucketOf(v)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, v)
+}
+
+// ObserveSince records the time since start, in microseconds.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(uint64(time.Since(start).Microseconds()))
+}
+
+// HistogramSnapshot is the state of a Histogram at some point.
+type HistogramSnapshot struct {
+	Buckets [NBUCKETS]uint64 // non-cumulative counts
+	Count   uint64
+	Sum     uint64
+}
+
+// Snapshot returns the current state of h.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	var s HistogramSnapshot
+	for i := range h.buckets {
+		s.Buckets[i] = atomic.LoadUint64(&h.buckets[i])
+	}
+	s.Count = atomic.LoadUint64(&h.count)
+	s.Sum = atomic.LoadUint64(&h.sum)
+	return s
+}
+
+// Mean returns the average value observed, or 0 if there are none.
+func (s HistogramSnapshot) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(s.Count)
+}
+
+// Writer writes statistics in the Prometheus text exposition format.
+//
+// The first error from the underlying writer is remembered and returned by
+// Err; later writes do nothing.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+func (w *Writer) header(name string, help string, kind string) {
+	w.printf("# HELP %s %s\n", name, help)
+	w.printf("# TYPE %s %s\n", name, kind)
+}
+
+// Counter writes a counter.
+func (w *Writer) Counter(name string, help string, v uint64) {
+	w.header(name, help, "counter")
+	w.printf("%s %d\n", name, v)
+}
+
+// Gauge writes a value that can go up and down.
+func (w *Writer) Gauge(name string, help string, v uint64) {
+	w.header(name, help, "gauge")
+	w.printf("%s %d\n", name, v)
+}
+
+// Histogram writes a histogram, multiplying values by scale (for example,
+// 1e-6 to report microseconds in seconds, as Prometheus recommends).
+func (w *Writer) Histogram(name string, help string, h *Histogram, scale float64) {
+	s := h.Snapshot()
+	w.header(name, help, "histogram")
+	var cum uint64
+	for i := 0; i < NBUCKETS-1; i++ {
+		cum += s.Buckets[i]
+		w.printf("%s_bucket{le=\"%g\"} %d\n", name, float64(uint64(1)<<i)*scale, cum)
+	}
+	// derive the count from the buckets, which the snapshot may not have read
+	// at the same instant as count
+	cum += s.Buckets[NBUCKETS-1]
+	w.printf("%s_bucket{le=\"+Inf\"} %d\n", name, cum)
+	w.printf("%s_sum %g\n", name, float64(s.Sum)*scale)
+	w.printf("%s_count %d\n", name, cum)
+}
+
+// Err returns the first error encountered while writing.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// Source is a set of statistics that can be exported.
+type Source interface {
+	WriteMetrics(w *Writer)
+}
+
+// Handler returns an HTTP handler that serves the statistics of srcs in the
+// Prometheus text format, for scraping by a monitoring system.
+func Handler(srcs ...Source) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w := NewWriter(rw)
+		for _, src := range srcs {
+			src.WriteMetrics(w)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketOf(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(0, bucketOf(0))
+	assert.Equal(0, bucketOf(1))
+	assert.Equal(1, bucketOf(2))
+	assert.Equal(2, bucketOf(3))
+	assert.Equal(2, bucketOf(4))
+	assert.Equal(3, bucketOf(5))
+	assert.Equal(NBUCKETS-1, bucketOf(^uint64(0)))
+}
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+	var h Histogram
+	for _, v := range []uint64{1, 2, 3, 4, 100} {
+		h.Observe(v)
+	}
+	s := h.Snapshot()
+	assert.Equal(uint64(5), s.Count)
+	assert.Equal(uint64(110), s.Sum)
+	assert.Equal(22.0, s.Mean())
+	assert.Equal(uint64(2), s.Buckets[2], "3 and 4")
+	assert.Equal(uint64(1), s.Buckets[7], "100 <= 128")
+}
+
+func TestWriter(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var c Counter
+	c.Add(3)
+	c.Inc()
+	w.Counter("things_total", "Things.", c.Load())
+	var h Histogram
+	h.Observe(2)
+	h.Observe(1000)
+	w.Histogram("latency_seconds", "Latency.", &h, 1e-6)
+	assert.NoError(w.Err())
+
+	out := buf.String()
+	assert.Contains(out, "# TYPE things_total counter\nthings_total 4\n")
+	assert.Contains(out, "latency_seconds_bucket{le=\"2e-06\"} 1\n")
+	assert.Contains(out, "latency_seconds_bucket{le=\"0.001024\"} 2\n")
+	assert.Contains(out, "latency_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(out, "latency_seconds_count 2\n")
+}
+
+type counterSource struct {
+	c *Counter
+}
+
+func (s counterSource) WriteMetrics(w *Writer) {
+	w.Counter("requests_total", "Requests.", s.c.Load())
+}
+
+func TestHandler(t *testing.T) {
+	var c Counter
+	c.Inc()
+	rec := httptest.NewRecorder()
+	Handler(counterSource{&c}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+	assert.Contains(t, rec.Body.String(), "requests_total 1\n")
+}
@@ -0,0 +1,42 @@
+package txn
+
+import (
+	"context"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/codec"
+)
+
+func checkObj[T any](txn *Txn, a addr.Addr, sz uint64) error {
+	if err := codec.Check[T](a, sz); err != nil {
+		return err
+	}
+	return txn.CheckObj(a, sz)
+}
+
+// ReadObj reads the object of size sz at a, like ReadBuf, and decodes it as a
+// T (see package codec for the supported types).
+//
+// Returns an error, without reading or locking anything, if a T does not
+// encode to exactly sz bits (codec.ErrSize) or the object does not match the
+// schema (schema.ErrSchema).
+func ReadObj[T any](txn *Txn, a addr.Addr, sz uint64) (T, error) {
+	if err := checkObj[T](txn, a, sz); err != nil {
+		var v T
+		return v, err
+	}
+	return codec.Decode[T](txn.ReadBuf(a, sz), sz)
+}
+
+// WriteObj encodes v and writes it to the object of size sz at a, like
+// OverWrite, but returns errors (as OverWriteCtx does) rather than panicking.
+func WriteObj[T any](txn *Txn, a addr.Addr, sz uint64, v T) error {
+	if err := checkObj[T](txn, a, sz); err != nil {
+		return err
+	}
+	data, err := codec.Encode(v, sz)
+	if err != nil {
+		return err
+	}
+	return txn.OverWriteCtx(context.Background(), a, sz, data)
+}
@@ -0,0 +1,46 @@
+package txn
+
+import (
+	"net/http"
+
+	"github.com/mit-pdos/go-journal/lockmap"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/stats"
+)
+
+// Stats are statistics about the transactions of a Log.
+type Stats struct {
+	Begins        stats.Counter
+	Commits       stats.Counter // successful commits
+	FailedCommits stats.Counter
+	Aborts        stats.Counter
+
+	Obj   *obj.Stats     // statistics of the object log and write-ahead log
+	Locks *lockmap.Stats // lock contention between transactions
+}
+
+// Stats returns the live statistics of tsys.
+func (tsys *Log) Stats() *Stats {
+	return tsys.stats
+}
+
+// WriteMetrics writes s, and the statistics of every layer below it, with
+// metric names prefixed by go_journal.
+func (s *Stats) WriteMetrics(w *stats.Writer) {
+	w.Counter("go_journal_txn_begins_total",
+		"Transactions started.", s.Begins.Load())
+	w.Counter("go_journal_txn_commits_total",
+		"Transactions committed.", s.Commits.Load())
+	w.Counter("go_journal_txn_failed_commits_total",
+		"Transactions whose commit failed.", s.FailedCommits.Load())
+	w.Counter("go_journal_txn_aborts_total",
+		"Transactions aborted.", s.Aborts.Load())
+	s.Locks.WriteMetrics(w)
+	s.Obj.WriteMetrics(w)
+}
+
+// MetricsHandler returns an HTTP handler that serves the statistics of tsys
+// (see Stats) in the Prometheus text format.
+func (tsys *Log) MetricsHandler() http.Handler {
+	return stats.Handler(tsys.stats)
+}
@@ -2,44 +2,163 @@
 //
 // Transactions in this package do not have to implement concurrency control,
 // since the package uses two-phase locking to automatically synchronize
-// transactions. Lock ordering is still up to the caller to avoid deadlocks.
+// transactions. Reads take shared locks, so transactions that only read an
+// object run concurrently, and writes take exclusive locks, upgrading the
+// shared lock from an earlier read.
+//
+// Lock ordering is still up to the caller to avoid deadlocks, unless the Log
+// is initialized with Opts.DetectDeadlocks, in which case a transaction that
+// would deadlock gets lockmap.ErrDeadlock and should abort and retry. Two
+// transactions that read and then write the same object cannot both upgrade
+// their shared locks, so the second write fails with lockmap.ErrDeadlock: the
+// transaction then fails to commit, and should be retried. A transaction that
+// will write an object it reads can Acquire it first to avoid this, and
+// Opts.ExclusiveReads makes every read do so.
 package txn
 
 import (
+	"context"
+	"sync/atomic"
+
 	"github.com/goose-lang/primitive/disk"
 
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/lockmap"
 	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/schema"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-journal/wal"
 )
 
 type Log struct {
 	log   *obj.Log
 	locks *lockmap.LockMap
+	// last owner ID assigned to a transaction
+	lastOwner *uint64
+	readMode  lockmap.Mode // mode in which reads lock objects
+	stats     *Stats
 }
 
 type Txn struct {
+	stats    *Stats
 	buftxn   *jrnl.Op
 	locks    *lockmap.LockMap
-	acquired map[uint64]bool
+	owner    uint64 // identifies this transaction's locks in locks
+	readMode lockmap.Mode
+	acquired map[uint64]lockmap.Mode
+	// err is set when OverWrite could not lock its object, and makes the
+	// commit fail
+	err      error
+	aborted  bool
+	finished bool // committed or aborted, for statistics
+	onDone   []func(committed bool)
+}
+
+// Opts configures a Log.
+type Opts struct {
+	// LogSz is the capacity of the log used to initialize an all-zero disk,
+	// which bounds the size of a transaction (0 means wal.LOGSZ).
+	LogSz uint64
+	// DetectDeadlocks makes Acquire fail with lockmap.ErrDeadlock rather than
+	// wait forever when transactions wait for each other's locks in a cycle.
+	DetectDeadlocks bool
+	// ExclusiveReads makes ReadBuf lock objects exclusively rather than in
+	// shared mode, so that transactions that read and then write the same
+	// object wait for each other instead of failing to commit (see package
+	// doc), at the cost of also serializing transactions that only read.
+	ExclusiveReads bool
+	// Schema, if non-nil, is checked on every object access (see
+	// obj.Log.SetSchema).
+	Schema *schema.Schema
+	// ReadOnly opens an existing journal without writing to the disk (see
+	// obj.OpenLogReadOnly): transactions read the recovered state, and
+	// committing a transaction with writes fails with wal.ErrReadOnly. LogSz
+	// is ignored.
+	ReadOnly bool
 }
 
 func Init(d disk.Disk) *Log {
+	return InitOpts(d, Opts{})
+}
+
+// InitLogSz is like Init, but initializes an all-zero disk with a log of logSz
+// blocks, which bounds the size of a transaction.
+func InitLogSz(d disk.Disk, logSz uint64) *Log {
+	return InitOpts(d, Opts{LogSz: logSz})
+}
+
+// InitOpts is like Init, with the options in opts.
+func InitOpts(d disk.Disk, opts Opts) *Log {
+	tsys, err := Open(d, opts)
+	if err != nil {
+		panic(err)
+	}
+	return tsys
+}
+
+// Open is like InitOpts, but returns an error rather than panicking if d does
+// not hold a usable journal: for example, if d holds something else
+// (wal.ErrNotJournal) or was formatted by an incompatible version
+// (wal.ErrVersion).
+func Open(d disk.Disk, opts Opts) (*Log, error) {
+	var logSz = opts.LogSz
+	if logSz == 0 {
+		logSz = wal.LOGSZ
+	}
+	var log *obj.Log
+	var err error
+	if opts.ReadOnly {
+		log, err = obj.OpenLogReadOnly(d)
+	} else {
+		log, err = obj.OpenLog(d, logSz)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.SetSchema(opts.Schema)
+	var locks *lockmap.LockMap
+	if opts.DetectDeadlocks {
+		locks = lockmap.MkLockMapWithDetection()
+	} else {
+		locks = lockmap.MkLockMap()
+	}
+	var readMode = lockmap.Shared
+	if opts.ExclusiveReads {
+		readMode = lockmap.Exclusive
+	}
 	twophasePre := &Log{
-		log:   obj.MkLog(d),
-		locks: lockmap.MkLockMap(),
+		log:       log,
+		locks:     locks,
+		lastOwner: new(uint64),
+		readMode:  readMode,
+		stats:     &Stats{Obj: log.Stats(), Locks: locks.Stats()},
 	}
-	return twophasePre
+	return twophasePre, nil
+}
+
+// Format writes a fresh journal with a log of opts.LogSz blocks to d,
+// discarding any transactions logged there, so that d can then be opened with
+// Init or Open.
+func Format(d disk.Disk, opts Opts) error {
+	return wal.Format(d, wal.FormatOpts{LogSz: opts.LogSz})
+}
+
+// LogSz returns the maximum number of blocks a transaction can write.
+func (tsys *Log) LogSz() uint64 {
+	return tsys.log.LogSz()
 }
 
 // Start a local transaction with no writes from a global Log.
 func Begin(tsys *Log) *Txn {
+	tsys.stats.Begins.Inc()
 	trans := &Txn{
+		stats:    tsys.stats,
 		buftxn:   jrnl.Begin(tsys.log),
 		locks:    tsys.locks,
-		acquired: make(map[uint64]bool),
+		owner:    atomic.AddUint64(tsys.lastOwner, 1),
+		readMode: tsys.readMode,
+		acquired: make(map[uint64]lockmap.Mode),
 	}
 	util.DPrintf(5, "tp Begin: %v\n", trans)
 	return trans
@@ -49,30 +168,87 @@ func (tsys *Log) Flush() {
 	tsys.log.Flush()
 }
 
-func (txn *Txn) acquireNoCheck(addr addr.Addr) {
-	flatAddr := addr.Flatid()
-	txn.locks.Acquire(flatAddr)
-	txn.acquired[flatAddr] = true
+// Checkpoint makes every committed transaction durable and installs it in
+// the data region, so that the data region alone is a consistent image, for
+// example before taking a snapshot of the disk (see wal.Walog.Checkpoint).
+func (tsys *Log) Checkpoint() error {
+	return tsys.log.Checkpoint()
 }
 
-func (txn *Txn) isAlreadyAcquired(addr addr.Addr) bool {
+// Shutdown stops the background threads of the underlying log, after which the
+// disk can be closed.
+func (tsys *Log) Shutdown() {
+	tsys.log.Shutdown()
+}
+
+// acquireMode acquires addr in mode, unless the transaction already holds it
+// in a mode at least as strong, upgrading a shared lock if necessary
+func (txn *Txn) acquireMode(ctx context.Context, addr addr.Addr, mode lockmap.Mode) error {
+	txn.checkNotAborted()
 	flatAddr := addr.Flatid()
-	return txn.acquired[flatAddr]
+	held, ok := txn.acquired[flatAddr]
+	if ok && (held == lockmap.Exclusive || mode == lockmap.Shared) {
+		return nil
+	}
+	var m = mode
+	if ok {
+		m = lockmap.Upgrade
+	}
+	err := txn.locks.AcquireMode(ctx, flatAddr, txn.owner, m)
+	if err != nil {
+		return err
+	}
+	txn.acquired[flatAddr] = mode
+	return nil
 }
 
-func (txn *Txn) Acquire(addr addr.Addr) {
-	already_acquired := txn.isAlreadyAcquired(addr)
-	if !already_acquired {
-		txn.acquireNoCheck(addr)
+// Acquire locks addr exclusively for the rest of the transaction.
+//
+// Acquire can only fail if the Log detects deadlocks, in which case it returns
+// an error wrapping lockmap.ErrDeadlock; the transaction still holds its other
+// locks, and should generally be aborted and retried.
+func (txn *Txn) Acquire(addr addr.Addr) error {
+	return txn.AcquireCtx(context.Background(), addr)
+}
+
+// AcquireCtx is like Acquire, but gives up and returns ctx.Err() if ctx is done
+// before the lock is acquired.
+func (txn *Txn) AcquireCtx(ctx context.Context, addr addr.Addr) error {
+	return txn.acquireMode(ctx, addr, lockmap.Exclusive)
+}
+
+// mustAcquire acquires addr in mode for an operation that cannot return an
+// error
+func (txn *Txn) mustAcquire(addr addr.Addr, mode lockmap.Mode) {
+	err := txn.acquireMode(context.Background(), addr, mode)
+	if err != nil {
+		panic(err)
 	}
 }
 
+// ReleaseAll releases all the locks acquired by the transaction, both shared
+// and exclusive.
 func (txn *Txn) ReleaseAll() {
 	for flatAddr := range txn.acquired {
-		txn.locks.Release(flatAddr)
+		txn.locks.ReleaseOwner(flatAddr, txn.owner)
+	}
+	txn.acquired = make(map[uint64]lockmap.Mode)
+}
+
+func (txn *Txn) checkNotAborted() {
+	if txn.aborted {
+		panic("txn: use of aborted transaction")
 	}
 }
 
+// CheckObj checks the object of size sz at addr against the Log's schema,
+// returning an error wrapping schema.ErrSchema if it does not match.
+//
+// ReadBuf and OverWrite panic on such objects.
+func (txn *Txn) CheckObj(addr addr.Addr, sz uint64) error {
+	return txn.buftxn.CheckObj(addr, sz)
+}
+
 func (txn *Txn) readBufNoAcquire(addr addr.Addr, sz uint64) []byte {
 	// PERFORMANCE-IMPACTING HACK:
 	// Copying out the data to a new slice isn't necessary,
@@ -82,17 +258,65 @@ func (txn *Txn) readBufNoAcquire(addr addr.Addr, sz uint64) []byte {
 	return s
 }
 
+// ReadBuf reads the object of size sz at addr, locking it for the rest of the
+// transaction in shared mode, so concurrent transactions can read it too
+// (exclusively, with Opts.ExclusiveReads).
+//
+// With deadlock detection, ReadBuf panics if acquiring the lock would
+// deadlock; callers that want to recover should use ReadBufCtx.
 func (txn *Txn) ReadBuf(addr addr.Addr, sz uint64) []byte {
-	txn.Acquire(addr)
+	txn.mustAcquire(addr, txn.readMode)
 	return txn.readBufNoAcquire(addr, sz)
 }
 
-// OverWrite writes an object to addr
+// ReadBufCtx is like ReadBuf, but returns an error rather than waiting for the
+// lock past ctx's deadline (ctx.Err()), deadlocking (lockmap.ErrDeadlock), or
+// accessing an object that does not match the schema (schema.ErrSchema).
+func (txn *Txn) ReadBufCtx(ctx context.Context, addr addr.Addr, sz uint64) ([]byte, error) {
+	if err := txn.CheckObj(addr, sz); err != nil {
+		return nil, err
+	}
+	err := txn.acquireMode(ctx, addr, txn.readMode)
+	if err != nil {
+		return nil, err
+	}
+	return txn.readBufNoAcquire(addr, sz), nil
+}
+
+// OverWrite writes an object to addr, locking it exclusively (upgrading a
+// shared lock from an earlier read).
+//
+// If the lock cannot be acquired, because another transaction is upgrading its
+// shared lock on the object too or because waiting would deadlock, the write
+// is dropped and the transaction fails to commit with the error, which wraps
+// lockmap.ErrDeadlock; the transaction keeps its other locks until then.
+// OverWriteCtx reports the error instead.
 func (txn *Txn) OverWrite(addr addr.Addr, sz uint64, data []byte) {
-	txn.Acquire(addr)
+	err := txn.acquireMode(context.Background(), addr, lockmap.Exclusive)
+	if err != nil {
+		util.DPrintf(1, "tp OverWrite %v: %v\n", addr, err)
+		if txn.err == nil {
+			txn.err = err
+		}
+		return
+	}
 	txn.buftxn.OverWrite(addr, sz, data)
 }
 
+// OverWriteCtx is like OverWrite, but returns an error rather than waiting for
+// the lock past ctx's deadline (ctx.Err()), deadlocking (lockmap.ErrDeadlock),
+// or accessing an object that does not match the schema (schema.ErrSchema).
+func (txn *Txn) OverWriteCtx(ctx context.Context, addr addr.Addr, sz uint64, data []byte) error {
+	if err := txn.CheckObj(addr, sz); err != nil {
+		return err
+	}
+	err := txn.AcquireCtx(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return txn.buftxn.OverWriteErr(addr, sz, data)
+}
+
 func (txn *Txn) ReadBufBit(addr addr.Addr) bool {
 	dataByte := txn.ReadBuf(addr, 1)[0]
 	return 1 == ((dataByte >> (addr.Off % 8)) & 1)
@@ -122,13 +346,88 @@ func (txn *Txn) NDirty() uint64 {
 	return txn.buftxn.NDirty()
 }
 
-func (txn *Txn) commitNoRelease(wait bool) bool {
+func (txn *Txn) commitNoRelease(wait bool) (obj.CommitHandle, error) {
 	util.DPrintf(5, "tp Commit %p\n", txn)
-	return txn.buftxn.CommitWait(wait)
+	return txn.buftxn.CommitErr(wait)
 }
 
+// Commit commits the transaction's writes and releases its locks.
+//
+// An aborted transaction cannot be committed and Commit returns false.
 func (txn *Txn) Commit(wait bool) bool {
-	ok := txn.commitNoRelease(wait)
-	txn.ReleaseAll()
+	_, ok := txn.CommitWithHandle(wait)
 	return ok
 }
+
+// CommitWithHandle is like Commit, but also returns a handle for learning when
+// the transaction is durable. After an asynchronous commit, waiting on the
+// handle waits only for this transaction (and earlier ones) to be durable,
+// rather than for whatever any thread has committed since.
+func (txn *Txn) CommitWithHandle(wait bool) (obj.CommitHandle, bool) {
+	h, err := txn.CommitErr(wait)
+	return h, err == nil
+}
+
+// CommitErr is like CommitWithHandle, but returns an error explaining why the
+// commit failed: jrnl.ErrAborted for an aborted transaction, the error from an
+// OverWrite that could not lock its object (see OverWrite), or
+// wal.ErrTxnTooLarge, wal.ErrOverflow, or wal.ErrLogShutdown from the log.
+// The transaction's locks are released either way.
+func (txn *Txn) CommitErr(wait bool) (obj.CommitHandle, error) {
+	if txn.aborted {
+		return obj.CommitHandle{}, jrnl.ErrAborted
+	}
+	if txn.err != nil {
+		txn.finished = true
+		txn.stats.FailedCommits.Inc()
+		txn.Abort()
+		return obj.CommitHandle{}, txn.err
+	}
+	h, err := txn.commitNoRelease(wait)
+	txn.finished = true
+	if err != nil {
+		txn.stats.FailedCommits.Inc()
+	} else {
+		txn.stats.Commits.Inc()
+	}
+	txn.ReleaseAll()
+	txn.runOnDone(err == nil)
+	return h, err
+}
+
+// Abort discards the transaction's writes and releases its locks.
+//
+// After Abort, reads and writes panic and Commit fails. Abort is safe to call
+// after Commit (for example, deferred on error paths), in which case there is
+// nothing left to release.
+func (txn *Txn) Abort() {
+	util.DPrintf(5, "tp Abort %p\n", txn)
+	if !txn.finished {
+		txn.stats.Aborts.Inc()
+		txn.finished = true
+	}
+	txn.buftxn.Abort()
+	txn.ReleaseAll()
+	txn.aborted = true
+	txn.runOnDone(false)
+}
+
+// OnDone registers f to be called when the transaction finishes, with
+// committed reporting whether its writes took effect: f is called with true
+// after a successful Commit, and with false after Abort or a failed Commit.
+//
+// Callbacks run in the order they were registered, after the transaction's
+// locks are released. This lets state kept outside the transaction (such as an
+// in-memory allocator) follow the transaction's outcome.
+func (txn *Txn) OnDone(f func(committed bool)) {
+	txn.checkNotAborted()
+	txn.onDone = append(txn.onDone, f)
+}
+
+func (txn *Txn) runOnDone(committed bool) {
+	fs := txn.onDone
+	txn.onDone = nil
+	for _, f := range fs {
+		f(committed)
+	}
+}
@@ -1,12 +1,21 @@
 package txn_test
 
 import (
+	"context"
+	"errors"
 	"math/rand"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/goose-lang/primitive/disk"
 	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/codec"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-journal/lockmap"
+	"github.com/mit-pdos/go-journal/schema"
 	"github.com/mit-pdos/go-journal/txn"
+	"github.com/mit-pdos/go-journal/wal"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,6 +25,9 @@ func data(sz int) []byte {
 	return d
 }
 
+// dataStart is the first block after a default-sized log
+const dataStart = wal.LOGDISKBLOCKS
+
 func blockAddr(a uint64) addr.Addr {
 	return addr.Addr{
 		Blkno: a,
@@ -32,11 +44,11 @@ func TestReadWrite(t *testing.T) {
 	x := data(4096)
 
 	tx := txn.Begin(tsys)
-	tx.OverWrite(blockAddr(513), blockSz, x)
+	tx.OverWrite(blockAddr(dataStart), blockSz, x)
 	tx.Commit(true)
 
 	tx = txn.Begin(tsys)
-	buf := tx.ReadBuf(blockAddr(513), blockSz)
+	buf := tx.ReadBuf(blockAddr(dataStart), blockSz)
 	assert.Equal(t, x, buf, "read incorrect data")
 	tx.ReleaseAll()
 }
@@ -48,12 +60,409 @@ func TestReadWriteAsync(t *testing.T) {
 	x := data(4096)
 
 	tx := txn.Begin(tsys)
-	tx.OverWrite(blockAddr(513), blockSz, x)
+	tx.OverWrite(blockAddr(dataStart), blockSz, x)
 	tx.Commit(false)
 	tsys.Flush()
 
 	tx = txn.Begin(tsys)
-	buf := tx.ReadBuf(blockAddr(513), blockSz)
+	buf := tx.ReadBuf(blockAddr(dataStart), blockSz)
 	assert.Equal(t, x, buf, "read incorrect data")
 	tx.ReleaseAll()
 }
+
+func TestAbort(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+
+	x := data(4096)
+	tx := txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart), blockSz, x)
+	tx.Commit(true)
+
+	tx = txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart), blockSz, data(4096))
+	tx.OverWrite(blockAddr(dataStart+1), blockSz, data(4096))
+	tx.Abort()
+	assert.False(tx.Commit(true), "aborted transaction should not commit")
+	assert.Panics(func() { tx.ReadBuf(blockAddr(dataStart), blockSz) })
+	assert.Panics(func() { tx.OverWrite(blockAddr(dataStart), blockSz, x) })
+	tx.Abort()
+
+	// would deadlock if the aborted transaction still held the locks
+	tx = txn.Begin(tsys)
+	assert.Equal(x, tx.ReadBuf(blockAddr(dataStart), blockSz),
+		"aborted write should have no effect")
+	assert.Equal(make([]byte, 4096), tx.ReadBuf(blockAddr(dataStart+1), blockSz))
+	assert.True(tx.Commit(true))
+	tx.Abort()
+
+	tx = txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart+1), blockSz, x)
+	tx.Commit(true)
+}
+
+func TestDeadlockDetection(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.InitOpts(d, txn.Opts{DetectDeadlocks: true})
+
+	tx1 := txn.Begin(tsys)
+	tx2 := txn.Begin(tsys)
+	assert.NoError(tx1.Acquire(blockAddr(dataStart)))
+	assert.NoError(tx2.Acquire(blockAddr(dataStart + 1)))
+
+	// whichever transaction completes the cycle gets an error, aborts, and
+	// lets the other one proceed
+	run := func(tx *txn.Txn, a addr.Addr) bool {
+		err := tx.Acquire(a)
+		if err != nil {
+			assert.True(errors.Is(err, lockmap.ErrDeadlock), "got %v", err)
+			tx.Abort()
+			return false
+		}
+		tx.OverWrite(a, blockSz, data(4096))
+		assert.True(tx.Commit(true))
+		return true
+	}
+	done := make(chan bool)
+	go func() { done <- run(tx1, blockAddr(dataStart+1)) }()
+	go func() { done <- run(tx2, blockAddr(dataStart)) }()
+	ok1 := <-done
+	ok2 := <-done
+	assert.True(ok1 != ok2, "exactly one transaction should deadlock")
+}
+
+func TestCtxTimeout(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+
+	tx1 := txn.Begin(tsys)
+	tx1.OverWrite(blockAddr(dataStart), blockSz, data(4096))
+
+	tx2 := txn.Begin(tsys)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := tx2.ReadBufCtx(ctx, blockAddr(dataStart), blockSz)
+	assert.Equal(context.DeadlineExceeded, err)
+	err = tx2.OverWriteCtx(ctx, blockAddr(dataStart), blockSz, data(4096))
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.NoError(tx2.OverWriteCtx(ctx, blockAddr(dataStart+1), blockSz, data(4096)),
+		"free lock should not time out")
+	tx2.Abort()
+
+	x := data(4096)
+	tx1.OverWrite(blockAddr(dataStart), blockSz, x)
+	assert.True(tx1.Commit(true))
+
+	tx2 = txn.Begin(tsys)
+	buf, err := tx2.ReadBufCtx(context.Background(), blockAddr(dataStart), blockSz)
+	assert.NoError(err)
+	assert.Equal(x, buf)
+	tx2.ReleaseAll()
+}
+
+func TestReadModifyWrite(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+
+	// both transactions read the object before either writes it, so only
+	// one of them can upgrade its shared lock; the other fails to commit
+	// rather than deadlocking
+	read := make(chan bool)
+	write := make(chan bool)
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			tx := txn.Begin(tsys)
+			b := tx.ReadBuf(blockAddr(dataStart), blockSz)
+			read <- true
+			<-write
+			b[0] += 1
+			tx.OverWrite(blockAddr(dataStart), blockSz, b)
+			_, err := tx.CommitErr(true)
+			done <- err
+		}()
+	}
+	<-read
+	<-read
+	close(write)
+	err1, err2 := <-done, <-done
+	assert.True((err1 == nil) != (err2 == nil), "got %v and %v", err1, err2)
+	for _, err := range []error{err1, err2} {
+		if err != nil {
+			assert.True(errors.Is(err, lockmap.ErrDeadlock), "got %v", err)
+		}
+	}
+
+	tx := txn.Begin(tsys)
+	assert.Equal(byte(1), tx.ReadBuf(blockAddr(dataStart), blockSz)[0])
+	tx.ReleaseAll()
+}
+
+func TestExclusiveReads(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.InitOpts(d, txn.Opts{ExclusiveReads: true})
+
+	// concurrent read-modify-write transactions on the same object
+	// serialize rather than failing
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			tx := txn.Begin(tsys)
+			b := tx.ReadBuf(blockAddr(dataStart), blockSz)
+			b[0] += 1
+			tx.OverWrite(blockAddr(dataStart), blockSz, b)
+			done <- tx.Commit(true)
+		}()
+	}
+	assert.True(<-done)
+	assert.True(<-done)
+
+	tx := txn.Begin(tsys)
+	assert.Equal(byte(2), tx.ReadBuf(blockAddr(dataStart), blockSz)[0])
+	tx.ReleaseAll()
+}
+
+func TestSharedReads(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+
+	x := data(4096)
+	tx := txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart), blockSz, x)
+	assert.True(tx.Commit(true))
+
+	// concurrent readers do not block each other
+	tx1 := txn.Begin(tsys)
+	tx2 := txn.Begin(tsys)
+	assert.Equal(x, tx1.ReadBuf(blockAddr(dataStart), blockSz))
+	assert.Equal(x, tx2.ReadBuf(blockAddr(dataStart), blockSz))
+
+	// but a writer waits for them
+	tx3 := txn.Begin(tsys)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := tx3.OverWriteCtx(ctx, blockAddr(dataStart), blockSz, data(4096))
+	assert.Equal(context.DeadlineExceeded, err)
+	tx3.Abort()
+
+	// tx1 upgrades once tx2 is done
+	tx2.ReleaseAll()
+	y := data(4096)
+	tx1.OverWrite(blockAddr(dataStart), blockSz, y)
+	assert.True(tx1.Commit(true))
+
+	tx = txn.Begin(tsys)
+	assert.Equal(y, tx.ReadBuf(blockAddr(dataStart), blockSz))
+	tx.ReleaseAll()
+}
+
+func TestFormatOpen(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	d.Write(0, data(4096))
+	_, err := txn.Open(d, txn.Opts{})
+	assert.True(errors.Is(err, wal.ErrNotJournal), "got %v", err)
+
+	assert.NoError(txn.Format(d, txn.Opts{LogSz: 1000}))
+	tsys, err := txn.Open(d, txn.Opts{})
+	assert.NoError(err)
+	assert.Equal(uint64(1000), tsys.LogSz())
+	tsys.Shutdown()
+}
+
+type testInode struct {
+	Size   uint64
+	Blocks [8]uint64
+}
+
+func TestReadWriteObj(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+	const sz = 8 * 72
+	a := addr.MkAddr(dataStart, 3*sz)
+
+	tx := txn.Begin(tsys)
+	ino := testInode{Size: 4096, Blocks: [8]uint64{600, 601}}
+	assert.NoError(txn.WriteObj(tx, a, sz, ino))
+	assert.True(tx.Commit(true))
+
+	tx = txn.Begin(tsys)
+	ino2, err := txn.ReadObj[testInode](tx, a, sz)
+	assert.NoError(err)
+	assert.Equal(ino, ino2)
+	_, err = txn.ReadObj[testInode](tx, a, 8*128)
+	assert.True(errors.Is(err, codec.ErrSize), "got %v", err)
+	tx.ReleaseAll()
+}
+
+func TestSchema(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	s := schema.MustNew(
+		schema.Region{Name: "inodes", Start: dataStart, Len: 10, ObjSz: 8 * 128},
+		schema.Region{Name: "data", Start: dataStart + 10, Len: 1000, ObjSz: blockSz},
+	)
+	tsys := txn.InitOpts(d, txn.Opts{Schema: s})
+
+	tx := txn.Begin(tsys)
+	tx.OverWrite(addr.MkAddr(dataStart, 8*128), 8*128, data(128))
+	tx.OverWrite(blockAddr(dataStart+10), blockSz, data(4096))
+	assert.Panics(func() {
+		tx.OverWrite(blockAddr(dataStart), blockSz, data(4096))
+	}, "writing a block over inodes should be caught")
+	err := tx.OverWriteCtx(context.Background(), blockAddr(dataStart), blockSz,
+		data(4096))
+	assert.True(errors.Is(err, schema.ErrSchema), "got %v", err)
+	_, err = tx.ReadBufCtx(context.Background(), addr.MkAddr(dataStart, 8), 8*128)
+	assert.True(errors.Is(err, schema.ErrSchema), "misaligned inode")
+	assert.True(tx.Commit(true))
+}
+
+func TestOnDone(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+
+	var results []bool
+	record := func(committed bool) { results = append(results, committed) }
+
+	tx := txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart), blockSz, data(4096))
+	tx.OnDone(record)
+	assert.True(tx.Commit(true))
+
+	tx = txn.Begin(tsys)
+	tx.OnDone(record)
+	tx.Abort()
+	tx.Abort()
+	assert.Equal([]bool{true, false}, results,
+		"callbacks should run once with the outcome")
+}
+
+func TestCommitErr(t *testing.T) {
+	assert := assert.New(t)
+	tsys := txn.Init(disk.NewMemDisk(10000))
+
+	tx := txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart), blockSz, data(4096))
+	err := tx.OverWriteCtx(context.Background(), blockAddr(dataStart), 8, data(1))
+	assert.True(errors.Is(err, jrnl.ErrSizeMismatch), "got %v", err)
+	_, err = tx.CommitErr(true)
+	assert.NoError(err)
+
+	tx = txn.Begin(tsys)
+	for i := uint64(0); i <= tsys.LogSz(); i++ {
+		tx.OverWrite(blockAddr(dataStart+i), blockSz, make([]byte, 4096))
+	}
+	_, err = tx.CommitErr(true)
+	assert.True(errors.Is(err, wal.ErrTxnTooLarge), "got %v", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tx = txn.Begin(tsys)
+	assert.NoError(tx.AcquireCtx(ctx, blockAddr(dataStart)),
+		"failed commit should release locks")
+	tx.Abort()
+
+	tx = txn.Begin(tsys)
+	tx.Abort()
+	_, err = tx.CommitErr(true)
+	assert.True(errors.Is(err, jrnl.ErrAborted), "got %v", err)
+	tsys.Shutdown()
+}
+
+// noWriteDisk panics on any write
+type noWriteDisk struct {
+	disk.Disk
+}
+
+func (d noWriteDisk) Write(a uint64, v disk.Block) {
+	panic("write to read-only disk")
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+	x := data(4096)
+	tx := txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart), blockSz, x)
+	assert.True(tx.Commit(true))
+	tsys.Shutdown()
+
+	tsys, err := txn.Open(noWriteDisk{d}, txn.Opts{ReadOnly: true})
+	assert.NoError(err)
+	tx = txn.Begin(tsys)
+	assert.Equal(x, tx.ReadBuf(blockAddr(dataStart), blockSz))
+	_, err = tx.CommitErr(true)
+	assert.NoError(err, "a read-only transaction can commit")
+
+	tx = txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart+1), blockSz, data(4096))
+	_, err = tx.CommitErr(true)
+	assert.True(errors.Is(err, wal.ErrReadOnly), "got %v", err)
+	tsys.Shutdown()
+
+	_, err = txn.Open(noWriteDisk{disk.NewMemDisk(10000)}, txn.Opts{ReadOnly: true})
+	assert.True(errors.Is(err, wal.ErrNotJournal), "got %v", err)
+}
+
+func TestCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+	x := data(4096)
+	tx := txn.Begin(tsys)
+	tx.OverWrite(blockAddr(dataStart), blockSz, x)
+	assert.True(tx.Commit(false))
+
+	assert.NoError(tsys.Checkpoint())
+	assert.Equal(x, []byte(d.Read(dataStart)), "checkpoint should install the write")
+	tsys.Shutdown()
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	tsys := txn.Init(disk.NewMemDisk(10000))
+
+	for i := 0; i < 3; i++ {
+		tx := txn.Begin(tsys)
+		tx.OverWrite(blockAddr(dataStart), blockSz, data(4096))
+		assert.True(tx.Commit(false))
+	}
+	tx := txn.Begin(tsys)
+	tx.Abort()
+	tx.Abort()
+	tx = txn.Begin(tsys)
+	assert.True(tx.Commit(true))
+	tx.Abort()
+	tsys.Flush()
+
+	s := tsys.Stats()
+	assert.Equal(uint64(5), s.Begins.Load())
+	assert.Equal(uint64(4), s.Commits.Load())
+	assert.Equal(uint64(1), s.Aborts.Load())
+	assert.Equal(uint64(3), s.Obj.Commits.Load())
+	assert.Equal(uint64(1), s.Obj.ReadOnlyCommits.Load())
+	assert.Equal(uint64(3), s.Obj.Wal.AppendBlocks.Load())
+	// the logger may have taken the first writes before later ones could be
+	// absorbed
+	assert.Equal(s.Obj.Wal.AppendBlocks.Load(),
+		s.Obj.Wal.Absorbed.Load()+s.Obj.Wal.LogBatch.Snapshot().Sum)
+	assert.Equal(uint64(3), s.Locks.Acquires.Load())
+
+	rec := httptest.NewRecorder()
+	tsys.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(body, "go_journal_txn_commits_total 4\n")
+	assert.Contains(body, "go_journal_obj_commits_total 3\n")
+	assert.Contains(body, "go_journal_wal_appends_total 3\n")
+	assert.Contains(body, "go_journal_lockmap_acquires_total 3\n")
+	tsys.Shutdown()
+}
@@ -0,0 +1,112 @@
+// Package txnalloc is a persistent allocator whose bitmap is stored on disk
+// and updated through transactions.
+//
+// Allocations and frees join the caller's txn.Txn: an allocated number is
+// recorded on disk only if the transaction commits, and a freed number becomes
+// available again only once the freeing transaction commits, so a crash or
+// abort never leaks or double-allocates a number. An in-memory alloc.Alloc
+// tracks numbers that are in use or reserved by running transactions; it is
+// rebuilt from the on-disk bitmap by Open.
+package txnalloc
+
+import (
+	"fmt"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/alloc"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/txn"
+	"github.com/mit-pdos/go-journal/util"
+)
+
+// Allocator allocates numbers in [1, max), recorded in a bitmap of
+// NumBlocks(max) blocks starting at block start. Number 0 is never allocated,
+// so that it can be used as a null value.
+type Allocator struct {
+	start common.Bnum
+	max   uint64
+	mem   *alloc.Alloc
+}
+
+// NumBlocks is the number of bitmap blocks for an allocator of max numbers.
+func NumBlocks(max uint64) uint64 {
+	return util.RoundUp(max, common.NBITBLOCK)
+}
+
+// Open recovers an allocator from its on-disk bitmap.
+//
+// Requires 0 < max and max % 8 == 0. An all-zero bitmap is a fresh allocator
+// with every number free.
+func Open(tsys *txn.Log, start common.Bnum, max uint64) *Allocator {
+	if !(0 < max && max%8 == 0) {
+		panic("txnalloc: invalid max, must be positive and divisible by 8")
+	}
+	bitmap := make([]byte, 0, max/8)
+	tx := txn.Begin(tsys)
+	for i := uint64(0); i < NumBlocks(max); i++ {
+		blk := tx.ReadBuf(addr.MkAddr(start+i, 0), common.NBITBLOCK)
+		n := util.Min(uint64(len(blk)), max/8-uint64(len(bitmap)))
+		bitmap = append(bitmap, blk[:n]...)
+	}
+	tx.ReleaseAll()
+	a := &Allocator{
+		start: start,
+		max:   max,
+		mem:   alloc.MkAlloc(bitmap),
+	}
+	a.mem.MarkUsed(0)
+	util.DPrintf(1, "txnalloc: recovered %d of %d free\n", a.mem.NumFree(), max)
+	return a
+}
+
+func (a *Allocator) bitAddr(num uint64) addr.Addr {
+	return addr.MkBitAddr(a.start, num)
+}
+
+// Alloc allocates a free number as part of tx, returning 0 if there are no
+// free numbers.
+//
+// The number is reserved immediately, so no other transaction can allocate
+// it. It is recorded as allocated on disk if tx commits, and is free again if
+// tx aborts or fails to commit.
+func (a *Allocator) Alloc(tx *txn.Txn) uint64 {
+	num := a.mem.AllocNum()
+	if num == 0 {
+		return 0
+	}
+	tx.OverWriteBit(a.bitAddr(num), true)
+	tx.OnDone(func(committed bool) {
+		if !committed {
+			a.mem.FreeNum(num)
+		}
+	})
+	return num
+}
+
+// Free frees num as part of tx.
+//
+// num is recorded as free on disk if tx commits, and only then becomes
+// available for other transactions to allocate.
+//
+// Panics if num is not allocated, as seen by tx: freeing a number twice would
+// let it be allocated twice.
+func (a *Allocator) Free(tx *txn.Txn, num uint64) {
+	if num == 0 || num >= a.max {
+		panic(fmt.Sprintf("txnalloc: free of invalid number %d", num))
+	}
+	if !tx.ReadBufBit(a.bitAddr(num)) {
+		panic(fmt.Sprintf("txnalloc: double free of %d", num))
+	}
+	tx.OverWriteBit(a.bitAddr(num), false)
+	tx.OnDone(func(committed bool) {
+		if committed {
+			a.mem.FreeNum(num)
+		}
+	})
+}
+
+// NumFree returns the number of free numbers. Numbers allocated or freed by
+// running transactions count as in use.
+func (a *Allocator) NumFree() uint64 {
+	return a.mem.NumFree()
+}
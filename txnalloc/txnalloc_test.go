@@ -0,0 +1,140 @@
+package txnalloc
+
+import (
+	"testing"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/txn"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+const bitmapStart = wal.LOGDISKBLOCKS
+
+func TestAllocCommit(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+	a := Open(tsys, bitmapStart, 1024)
+	assert.Equal(uint64(1023), a.NumFree())
+
+	tx := txn.Begin(tsys)
+	n1 := a.Alloc(tx)
+	n2 := a.Alloc(tx)
+	assert.NotEqual(uint64(0), n1)
+	assert.NotEqual(n1, n2)
+	assert.Equal(uint64(1021), a.NumFree())
+	assert.True(tx.Commit(true))
+	tsys.Shutdown()
+
+	tsys = txn.Init(d)
+	a = Open(tsys, bitmapStart, 1024)
+	assert.Equal(uint64(1021), a.NumFree(), "allocations should persist")
+	tx = txn.Begin(tsys)
+	assert.True(tx.ReadBufBit(a.bitAddr(n1)))
+	assert.True(tx.ReadBufBit(a.bitAddr(n2)))
+	tx.ReleaseAll()
+	tsys.Shutdown()
+}
+
+func TestAllocAbort(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+	a := Open(tsys, bitmapStart, 1024)
+
+	tx := txn.Begin(tsys)
+	n := a.Alloc(tx)
+	tx.Abort()
+	assert.Equal(uint64(1023), a.NumFree(), "abort should roll back allocation")
+
+	tx = txn.Begin(tsys)
+	assert.False(tx.ReadBufBit(a.bitAddr(n)))
+	tx.ReleaseAll()
+	tsys.Shutdown()
+}
+
+func TestFreeOnCommit(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+	a := Open(tsys, bitmapStart, 16)
+
+	tx := txn.Begin(tsys)
+	var nums []uint64
+	for {
+		n := a.Alloc(tx)
+		if n == 0 {
+			break
+		}
+		nums = append(nums, n)
+	}
+	assert.Len(nums, 15)
+	assert.True(tx.Commit(true))
+
+	tx = txn.Begin(tsys)
+	a.Free(tx, nums[3])
+	tx2 := txn.Begin(tsys)
+	assert.Equal(uint64(0), a.Alloc(tx2),
+		"number should not be reused before the free commits")
+	tx2.Abort()
+	tx.Abort()
+	assert.Equal(uint64(0), a.NumFree(), "aborted free has no effect")
+
+	tx = txn.Begin(tsys)
+	a.Free(tx, nums[3])
+	assert.True(tx.Commit(true))
+	assert.Equal(uint64(1), a.NumFree())
+	tx = txn.Begin(tsys)
+	assert.Equal(nums[3], a.Alloc(tx))
+	assert.True(tx.Commit(true))
+	tsys.Shutdown()
+}
+
+func TestDoubleFree(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	tsys := txn.Init(d)
+	a := Open(tsys, bitmapStart, 16)
+
+	tx := txn.Begin(tsys)
+	n := a.Alloc(tx)
+	assert.True(tx.Commit(true))
+
+	tx = txn.Begin(tsys)
+	a.Free(tx, n)
+	assert.Panics(func() { a.Free(tx, n) }, "double free in one transaction")
+	assert.True(tx.Commit(true))
+	assert.Equal(uint64(15), a.NumFree())
+
+	tx = txn.Begin(tsys)
+	assert.Panics(func() { a.Free(tx, n) }, "free of a free number")
+	assert.Panics(func() { a.Free(tx, n+1) }, "free of a never-allocated number")
+	tx.Abort()
+	assert.Equal(uint64(15), a.NumFree())
+	tsys.Shutdown()
+}
+
+func TestCommitTooLarge(t *testing.T) {
+	d := disk.NewMemDisk(10000)
+	tsys := txn.InitLogSz(d, 16)
+	a := Open(tsys, common.Bnum(100), 1024)
+	tx := txn.Begin(tsys)
+	a.Alloc(tx)
+	// fill the transaction with more blocks than fit in the log
+	for i := uint64(0); i < 17; i++ {
+		tx.OverWrite(blockAddr(200+i), common.NBITBLOCK,
+			make([]byte, disk.BlockSize))
+	}
+	assert.False(t, tx.Commit(true))
+	assert.Equal(t, uint64(1023), a.NumFree(),
+		"failed commit should roll back allocation")
+	tsys.Shutdown()
+}
+
+func blockAddr(bn common.Bnum) addr.Addr {
+	return addr.MkAddr(bn, 0)
+}
@@ -15,23 +15,73 @@
 // as long as possible to maximize the chance of absorption (i.e.,
 // commitWait or log is full).  It may better to start logging
 // earlier.
+//
+// The on-disk log of capacity sz occupies the first LogDiskBlocks(sz) blocks of
+// the disk:
+//
+// [ super | hdr | hdr2 | address blocks | sz log blocks ]
+//
+// The superblock identifies the disk as a journal and records the format
+// version and geometry (see Superblock). The address blocks hold one entry
+// (home address and checksum) per log block, HDRADDRS entries per block.
+//
+// Appending rewrites the address blocks that hold the new entries, and those
+// blocks also hold entries for positions already in the log. So that a torn
+// write cannot damage them, each address block is kept in two copies, each
+// with a checksum and a generation number: a write goes to the copy not
+// holding the newest generation, and recovery uses the newest copy that
+// passes its checksum.
+//
+// The default capacity LOGSZ is 511 blocks, as in the original header-only
+// format. The address blocks make the default log 7 blocks longer, so the data
+// region starts at block 520 rather than 513; the superblock records where it
+// starts (Superblock.DataStart).
 package wal
 
 import (
 	"github.com/goose-lang/primitive/disk"
 
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
 )
 
 const (
-	HDRMETA       = uint64(8) // space for the end position
-	HDRADDRS      = (disk.BlockSize - HDRMETA) / 8
-	LOGSZ         = HDRADDRS
-	LOGDISKBLOCKS = HDRADDRS + 2 // 2 for log header
+	HDRMETA  = uint64(16) // space for the checksum and generation of an address block
+	HDRENTRY = uint64(16) // space for an address, checksum, and flags
+	HDRADDRS = (disk.BlockSize - HDRMETA) / HDRENTRY
+	// LOGSZ is the default log capacity, which bounds the size of a
+	// transaction.
+	LOGSZ         = uint64(511)
+	LOGDISKBLOCKS = LOGADDRS + 2*((LOGSZ+HDRADDRS-1)/HDRADDRS) + LOGSZ
 )
 
 const (
-	LOGHDR   = common.Bnum(0)
-	LOGHDR2  = common.Bnum(1)
-	LOGSTART = common.Bnum(2)
+	LOGSUPER = common.Bnum(0)
+	LOGHDR   = common.Bnum(1)
+	LOGHDR2  = common.Bnum(2)
+	LOGADDRS = common.Bnum(3)
 )
+
+// addrBlocks is the number of address blocks for a log of capacity sz, not
+// counting their second copies
+func addrBlocks(sz uint64) uint64 {
+	return util.RoundUp(sz, HDRADDRS)
+}
+
+// addrCopy is the disk block holding the copy of address block i used for
+// generation gen
+func addrCopy(i uint64, gen uint64) common.Bnum {
+	return LOGADDRS + 2*i + gen%2
+}
+
+// logStart is the first log block for a log of capacity sz
+func logStart(sz uint64) common.Bnum {
+	return LOGADDRS + 2*addrBlocks(sz)
+}
+
+// LogDiskBlocks is the number of blocks used by a log of capacity sz.
+//
+// The data region starts after these blocks.
+func LogDiskBlocks(sz uint64) uint64 {
+	return logStart(sz) + sz
+}
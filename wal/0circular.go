@@ -1,6 +1,11 @@
 package wal
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
 	"github.com/goose-lang/primitive/disk"
 	"github.com/tchajed/marshal"
 
@@ -20,86 +25,348 @@ func MkBlockData(bn common.Bnum, blk disk.Block) Update {
 	return b
 }
 
+// ErrCorruptHeader is returned by recovery when a log header fails its
+// checksum or describes an impossible log.
+var ErrCorruptHeader = errors.New("wal: corrupt log header")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// entryChecksum covers the home address, the transaction-boundary flag, and
+// the contents of a logged block, so that a log block paired with the wrong
+// entry is also detected.
+func entryChecksum(addr common.Bnum, last bool, blk disk.Block) uint32 {
+	enc := marshal.NewEnc(9)
+	enc.PutInt(addr)
+	enc.PutBool(last)
+	sum := crc32.Update(0, crcTable, enc.Finish())
+	return crc32.Update(sum, crcTable, blk)
+}
+
+// hdrChecksum covers everything in a header block after the checksum itself,
+// which is stored in the first 8 bytes.
+func hdrChecksum(hdr disk.Block) uint64 {
+	return uint64(crc32.Checksum(hdr[8:], crcTable))
+}
+
+func isZeroBlock(blk disk.Block) bool {
+	for _, b := range blk {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isFreshHdr reports whether a header block is either unwritten or was written
+// by initCircular (as fresh)
+func isFreshHdr(hdr disk.Block, fresh disk.Block) bool {
+	return isZeroBlock(hdr) || bytes.Equal(hdr, fresh)
+}
+
+// logEntry describes one slot of the on-disk circular log.
+type logEntry struct {
+	addr common.Bnum
+	sum  uint32 // entryChecksum of the logged block
+	// last is set on the final block of each Append, which marks a
+	// transaction boundary that recovery can stop at
+	last bool
+}
+
 type circularAppender struct {
-	diskAddrs []uint64
+	sz      uint64 // capacity of the log, in blocks
+	entries []logEntry
+	// generation of the newest on-disk copy of each address block
+	gens []uint64
 }
 
 // initCircular takes ownership of the circular log, which is the first
-// LOGDISKBLOCKS of the disk.
-func initCircular(d disk.Disk) *circularAppender {
-	b0 := make([]byte, disk.BlockSize)
-	d.Write(LOGHDR, b0)
-	d.Write(LOGHDR2, b0)
-	addrs := make([]uint64, HDRADDRS)
-	return &circularAppender{
-		diskAddrs: addrs,
+// LogDiskBlocks(sz) of the disk, and formats an empty log of capacity sz.
+func initCircular(d disk.Disk, sz uint64) *circularAppender {
+	c := &circularAppender{
+		sz:      sz,
+		entries: make([]logEntry, sz),
+		gens:    make([]uint64, addrBlocks(sz)),
+	}
+	// invalidate any existing superblock first, so that a crash cannot
+	// leave it describing the new headers
+	d.Write(LOGSUPER, make(disk.Block, disk.BlockSize))
+	d.Barrier()
+	// clear address blocks from an earlier log, whose generations could
+	// be newer than the ones written from now on
+	for bn := LOGADDRS; bn < logStart(sz); bn++ {
+		d.Write(bn, make(disk.Block, disk.BlockSize))
+	}
+	d.Write(LOGHDR, hdr1(0))
+	d.Write(LOGHDR2, hdr2(0))
+	d.Barrier()
+	d.Write(LOGSUPER, encodeSuper(mkSuperblock(sz)))
+	d.Barrier()
+	return c
+}
+
+// sealHdr fills in the checksum of an encoded header block
+func sealHdr(hdr disk.Block) disk.Block {
+	enc := marshal.NewEncFromSlice(hdr)
+	enc.PutInt(hdrChecksum(hdr))
+	return hdr
+}
+
+// checkHdr verifies the checksum of a header block
+func checkHdr(bn common.Bnum, hdr disk.Block) error {
+	dec := marshal.NewDec(hdr)
+	sum := dec.GetInt()
+	if sum != hdrChecksum(hdr) {
+		return fmt.Errorf("%w: checksum mismatch in block %d", ErrCorruptHeader, bn)
 	}
+	return nil
 }
 
-// decodeHdr1 decodes (end, start) from hdr1
-func decodeHdr1(hdr1 disk.Block) (uint64, []uint64) {
+// decodeHdr1 decodes end from hdr1
+func decodeHdr1(hdr1 disk.Block) uint64 {
 	dec1 := marshal.NewDec(hdr1)
+	_ = dec1.GetInt() // checksum
 	end := dec1.GetInt()
-	addrs := dec1.GetInts(HDRADDRS)
-	return end, addrs
+	return end
+}
+
+// readAddrBlock returns the newest copy of address block i that passes its
+// checksum, and its generation. If neither copy does, returns nil.
+func readAddrBlock(d disk.Disk, i uint64) (disk.Block, uint64) {
+	var newest disk.Block
+	var gen = uint64(0)
+	for c := uint64(0); c < 2; c++ {
+		bn := addrCopy(i, c)
+		blk := d.Read(bn)
+		if checkHdr(bn, blk) != nil {
+			continue
+		}
+		dec := marshal.NewDec(blk)
+		_ = dec.GetInt() // checksum
+		g := dec.GetInt()
+		if newest == nil || g > gen {
+			newest = blk
+			gen = g
+		}
+	}
+	return newest, gen
+}
+
+// decodeAddrs decodes the entries for a log of capacity sz from the newest
+// valid copies of its address blocks, also returning their generations.
+//
+// Entries in an address block with no valid copy are left zero, so that the
+// positions they describe fail their checksums.
+func decodeAddrs(d disk.Disk, sz uint64) ([]logEntry, []uint64) {
+	entries := make([]logEntry, sz)
+	gens := make([]uint64, addrBlocks(sz))
+	for i := uint64(0); i < addrBlocks(sz); i++ {
+		blk, gen := readAddrBlock(d, i)
+		if blk == nil {
+			util.DPrintf(1, "decodeAddrs: no valid copy of address block %d\n", i)
+			continue
+		}
+		gens[i] = gen
+		dec := marshal.NewDec(blk)
+		_ = dec.GetInt() // checksum
+		_ = dec.GetInt() // generation
+		for j := i * HDRADDRS; j < util.Min((i+1)*HDRADDRS, sz); j++ {
+			entries[j].addr = dec.GetInt()
+			entries[j].sum = dec.GetInt32()
+			entries[j].last = dec.GetInt32() != 0
+		}
+	}
+	return entries, gens
 }
 
 // decodeHdr2 reads start from hdr2
 func decodeHdr2(hdr2 disk.Block) uint64 {
 	dec2 := marshal.NewDec(hdr2)
+	_ = dec2.GetInt() // checksum
 	start := dec2.GetInt()
 	return start
 }
 
-func recoverCircular(d disk.Disk) (*circularAppender, LogPosition, LogPosition, []Update) {
+// recoverCircular reads the on-disk log, returning the logged updates in
+// [start, end).
+//
+// A disk without a log (all-zero superblock and headers) is formatted with an
+// empty log of capacity sz, unless readOnly is set, in which case recovery
+// fails with ErrNotJournal; otherwise the superblock must describe a journal
+// in the current format, and its capacity is used. Recovering an existing log
+// writes to the disk only to truncate a torn tail, and never when readOnly is
+// set.
+//
+// Every logged block is checked against the checksum in its entry. Recovery
+// stops at the first block that fails its checksum and truncates the log to
+// the last complete transaction before it, so a torn or reordered append is
+// never partially replayed. The truncation is made durable before returning,
+// since otherwise a later append that commits at some position before the old
+// end and then crashes before its own end header would bring the torn blocks
+// back. Headers that fail their own checksum are reported as ErrCorruptHeader.
+func recoverCircular(d disk.Disk, sz uint64, readOnly bool) (*circularAppender, LogPosition, LogPosition, []Update, error) {
+	super := d.Read(LOGSUPER)
+	if isZeroBlock(super) && readOnly {
+		return nil, 0, 0, nil, fmt.Errorf("%w: no superblock", ErrNotJournal)
+	}
+	if isZeroBlock(super) {
+		// only format a disk that looks unused (or whose formatting was
+		// interrupted), not one that happens to have a zero first block
+		if !isFreshHdr(d.Read(LOGHDR), hdr1(0)) ||
+			!isFreshHdr(d.Read(LOGHDR2), hdr2(0)) {
+			return nil, 0, 0, nil, fmt.Errorf("%w: no superblock", ErrNotJournal)
+		}
+		if sz == 0 || LogDiskBlocks(sz) > d.Size() {
+			return nil, 0, 0, nil, fmt.Errorf(
+				"wal: log of %d blocks does not fit on a disk of %d blocks",
+				sz, d.Size())
+		}
+		util.DPrintf(1, "recoverCircular: formatting log of size %d\n", sz)
+		return initCircular(d, sz), 0, 0, nil, nil
+	}
+	s, err := decodeSuper(d, super)
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+	sz = s.LogSz
 	hdr1 := d.Read(LOGHDR)
 	hdr2 := d.Read(LOGHDR2)
-	end, addrs := decodeHdr1(hdr1)
+	if err := checkHdr(LOGHDR, hdr1); err != nil {
+		return nil, 0, 0, nil, err
+	}
+	if err := checkHdr(LOGHDR2, hdr2); err != nil {
+		return nil, 0, 0, nil, err
+	}
+	end := decodeHdr1(hdr1)
 	start := decodeHdr2(hdr2)
+	if !(start <= end && end-start <= sz) {
+		return nil, 0, 0, nil, fmt.Errorf("%w: invalid log bounds [%d, %d)",
+			ErrCorruptHeader, start, end)
+	}
+	entries, gens := decodeAddrs(d, sz)
 	var bufs []Update
+	var validEnd = start
 	for pos := start; pos < end; pos++ {
-		addr := addrs[pos%LOGSZ]
-		b := d.Read(LOGSTART + pos%LOGSZ)
-		bufs = append(bufs, Update{Addr: addr, Block: b})
+		e := entries[pos%sz]
+		b := d.Read(logStart(sz) + pos%sz)
+		if entryChecksum(e.addr, e.last, b) != e.sum {
+			util.DPrintf(1, "recoverCircular: checksum mismatch at pos %d; "+
+				"truncating log to %d\n", pos, validEnd)
+			break
+		}
+		bufs = append(bufs, Update{Addr: e.addr, Block: b})
+		if e.last {
+			validEnd = pos + 1
+		}
+	}
+	if validEnd < end && !readOnly {
+		if err := truncateErr(d, LogPosition(validEnd)); err != nil {
+			return nil, 0, 0, nil, err
+		}
 	}
 	return &circularAppender{
-		diskAddrs: addrs,
-	}, LogPosition(start), LogPosition(end), bufs
+		sz:      sz,
+		entries: entries,
+		gens:    gens,
+	}, LogPosition(start), LogPosition(validEnd), bufs[:validEnd-start], nil
 }
 
-func (c *circularAppender) hdr1(end LogPosition) disk.Block {
+func hdr1(end LogPosition) disk.Block {
 	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(0) // checksum, filled in by sealHdr
 	enc.PutInt(uint64(end))
-	enc.PutInts(c.diskAddrs)
-	return enc.Finish()
+	return sealHdr(enc.Finish())
+}
+
+// addrBlock encodes generation gen of address block i from the in-memory
+// entries
+func (c *circularAppender) addrBlock(i uint64, gen uint64) disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(0) // checksum, filled in by sealHdr
+	enc.PutInt(gen)
+	for _, e := range c.entries[i*HDRADDRS : util.Min((i+1)*HDRADDRS, c.sz)] {
+		enc.PutInt(e.addr)
+		enc.PutInt32(e.sum)
+		if e.last {
+			enc.PutInt32(1)
+		} else {
+			enc.PutInt32(0)
+		}
+	}
+	return sealHdr(enc.Finish())
 }
 
 func hdr2(start LogPosition) disk.Block {
 	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(0) // checksum, filled in by sealHdr
 	enc.PutInt(uint64(start))
-	return enc.Finish()
+	return sealHdr(enc.Finish())
 }
 
-func (c *circularAppender) logBlocks(d disk.Disk, end LogPosition, bufs []Update) {
+func (c *circularAppender) logBlocks(d disk.Disk, end LogPosition, bufs []Update) error {
 	for i, buf := range bufs {
 		pos := end + LogPosition(i)
 		blk := buf.Block
 		blkno := buf.Addr
 		util.DPrintf(5,
 			"logBlocks: %d to log block %d\n", blkno, pos)
-		d.Write(LOGSTART+uint64(pos)%LOGSZ, blk)
-		c.diskAddrs[uint64(pos)%LOGSZ] = blkno
+		last := i == len(bufs)-1
+		if err := writeErr(d, logStart(c.sz)+uint64(pos)%c.sz, blk); err != nil {
+			return err
+		}
+		c.entries[uint64(pos)%c.sz] = logEntry{
+			addr: blkno,
+			sum:  entryChecksum(blkno, last, blk),
+			last: last,
+		}
 	}
+	return nil
 }
 
-func (c *circularAppender) Append(d disk.Disk, end LogPosition, bufs []Update) {
-	c.logBlocks(d, end, bufs)
-	d.Barrier()
-	// atomic installation
+// logAddrs writes the address blocks holding entries for positions [end,
+// newEnd).
+//
+// These blocks also hold entries for positions already in the log, so each
+// one is written as a new generation to the copy that does not hold the
+// newest generation. If the write is torn, recovery falls back to the other
+// copy, whose entries for the committed log are the same.
+func (c *circularAppender) logAddrs(d disk.Disk, end LogPosition, newEnd LogPosition) error {
+	var written = make(map[uint64]bool)
+	for pos := uint64(end); pos < uint64(newEnd); pos++ {
+		i := pos % c.sz / HDRADDRS
+		if !written[i] {
+			gen := c.gens[i] + 1
+			if err := writeErr(d, addrCopy(i, gen), c.addrBlock(i, gen)); err != nil {
+				return err
+			}
+			c.gens[i] = gen
+			written[i] = true
+		}
+	}
+	return nil
+}
+
+// Append logs bufs at end and commits them by writing the end header.
+//
+// If the disk reports an error, Append stops and returns it. The entries
+// already updated in memory are for positions past the committed end of the
+// log, so the on-disk log is unaffected.
+func (c *circularAppender) Append(d disk.Disk, end LogPosition, bufs []Update) error {
+	if err := c.logBlocks(d, end, bufs); err != nil {
+		return err
+	}
 	newEnd := end + LogPosition(len(bufs))
-	b := c.hdr1(newEnd)
-	d.Write(LOGHDR, b)
-	d.Barrier()
+	if err := c.logAddrs(d, end, newEnd); err != nil {
+		return err
+	}
+	if err := barrierErr(d); err != nil {
+		return err
+	}
+	// atomic installation
+	b := hdr1(newEnd)
+	if err := writeErr(d, LOGHDR, b); err != nil {
+		return err
+	}
+	return barrierErr(d)
 }
 
 func Advance(d disk.Disk, newStart LogPosition) {
@@ -107,3 +374,29 @@ func Advance(d disk.Disk, newStart LogPosition) {
 	d.Write(LOGHDR2, b)
 	d.Barrier()
 }
+
+// advanceErr is like Advance, but reports errors from an ErrorDisk
+func advanceErr(d disk.Disk, newStart LogPosition) error {
+	b := hdr2(newStart)
+	if err := writeErr(d, LOGHDR2, b); err != nil {
+		return err
+	}
+	return barrierErr(d)
+}
+
+// Truncate discards the on-disk log from newEnd on by rewriting the end
+// header. It is meant for offline repair: the log must not be open.
+func Truncate(d disk.Disk, newEnd LogPosition) {
+	b := hdr1(newEnd)
+	d.Write(LOGHDR, b)
+	d.Barrier()
+}
+
+// truncateErr is like Truncate, but reports errors from an ErrorDisk
+func truncateErr(d disk.Disk, newEnd LogPosition) error {
+	b := hdr1(newEnd)
+	if err := writeErr(d, LOGHDR, b); err != nil {
+		return err
+	}
+	return barrierErr(d)
+}
@@ -3,14 +3,15 @@ package wal
 import (
 	"github.com/goose-lang/primitive/disk"
 
-	"github.com/mit-pdos/go-journal/common"
-
 	"sync"
 )
 
 type WalogState struct {
 	memLog  *sliding
 	diskEnd LogPosition
+	// err is set (wrapping ErrIO) if the disk failed, after which nothing
+	// more is logged or installed, or to ErrReadOnly for a read-only log
+	err error
 
 	// For shutdown:
 	shutdown bool
@@ -32,8 +33,12 @@ type Walog struct {
 
 	// For shutdown:
 	condShut *sync.Cond
+
+	stats *Stats
 }
 
+// LogSz returns the capacity of the log, the maximum number of blocks in a
+// single transaction.
 func (l *Walog) LogSz() uint64 {
-	return common.HDRADDRS
+	return l.circ.sz
 }
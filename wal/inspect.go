@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"fmt"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+)
+
+// LogEntry describes one position of the on-disk log.
+type LogEntry struct {
+	Pos      LogPosition
+	Addr     common.Bnum // home address of the logged block
+	LogBlock common.Bnum // block of the log region holding the logged block
+	// ChecksumOK reports whether the logged block matches the checksum in its
+	// entry
+	ChecksumOK bool
+	// Last is set on the final block of each transaction
+	Last bool
+	// Replayed reports whether recovery would install this position
+	Replayed bool
+}
+
+// LogInfo is the on-disk state of a journal, as decoded by Inspect.
+type LogInfo struct {
+	Super Superblock
+	Start LogPosition // from LOGHDR2
+	End   LogPosition // from LOGHDR
+	// ValidEnd is where recovery would truncate the log: the end of the last
+	// complete transaction before the first block that fails its checksum
+	ValidEnd LogPosition
+	// HdrErr is non-nil if a header fails its checksum or the headers
+	// describe an impossible log, in which case recovery would fail. Start
+	// and End are still decoded, but Entries is empty if they are invalid.
+	HdrErr  error
+	Entries []LogEntry // positions [Start, End)
+}
+
+// Inspect decodes the on-disk log without modifying d or replaying anything,
+// for debugging. It follows the same rules as recovery to determine which
+// positions would be replayed.
+//
+// Returns an error only if the superblock cannot be read (see ReadSuperblock);
+// problems with the log itself are reported in the result.
+func Inspect(d disk.Disk) (*LogInfo, error) {
+	s, err := ReadSuperblock(d)
+	if err != nil {
+		return nil, err
+	}
+	sz := s.LogSz
+	hdr1 := d.Read(LOGHDR)
+	hdr2 := d.Read(LOGHDR2)
+	info := &LogInfo{
+		Super: s,
+		Start: LogPosition(decodeHdr2(hdr2)),
+		End:   LogPosition(decodeHdr1(hdr1)),
+	}
+	info.ValidEnd = info.Start
+	if err := checkHdr(LOGHDR, hdr1); err != nil {
+		info.HdrErr = err
+	} else if err := checkHdr(LOGHDR2, hdr2); err != nil {
+		info.HdrErr = err
+	}
+	start := uint64(info.Start)
+	end := uint64(info.End)
+	if !(start <= end && end-start <= sz) {
+		info.HdrErr = fmt.Errorf("%w: invalid log bounds [%d, %d)",
+			ErrCorruptHeader, start, end)
+		return info, nil
+	}
+	entries, _ := decodeAddrs(d, sz)
+	var torn = false
+	for pos := start; pos < end; pos++ {
+		e := entries[pos%sz]
+		bn := logStart(sz) + pos%sz
+		ok := entryChecksum(e.addr, e.last, d.Read(bn)) == e.sum
+		if !ok {
+			torn = true
+		}
+		if !torn && e.last {
+			info.ValidEnd = LogPosition(pos + 1)
+		}
+		info.Entries = append(info.Entries, LogEntry{
+			Pos:        LogPosition(pos),
+			Addr:       e.addr,
+			LogBlock:   bn,
+			ChecksumOK: ok,
+			Last:       e.last,
+		})
+	}
+	for i := range info.Entries {
+		info.Entries[i].Replayed = info.HdrErr == nil &&
+			info.Entries[i].Pos < info.ValidEnd
+	}
+	return info, nil
+}
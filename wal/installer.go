@@ -1,6 +1,9 @@
 package wal
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/goose-lang/primitive/disk"
 
 	"github.com/mit-pdos/go-journal/util"
@@ -31,13 +34,30 @@ func absorbBufs(bufs []Update) []Update {
 // (2) at all intermediate points,
 // the data region either has the value from the old transaction or the new
 // transaction (with all of bufs applied).
-func installBlocks(d disk.Disk, bufs []Update) {
+func installBlocks(d disk.Disk, bufs []Update) error {
 	for i, buf := range bufs {
 		blkno := buf.Addr
 		blk := buf.Block
 		util.DPrintf(5, "installBlocks: write log block %d to %d\n", i, blkno)
-		d.Write(blkno, blk)
+		if err := writeErr(d, blkno, blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installTxn installs bufs and then advances the on-disk log start to
+// installEnd, stopping at the first error
+//
+// Installing is idempotent, so a failed installTxn can be retried.
+func installTxn(d disk.Disk, bufs []Update, installEnd LogPosition) error {
+	if err := installBlocks(d, bufs); err != nil {
+		return err
 	}
+	if err := barrierErr(d); err != nil {
+		return err
+	}
+	return advanceErr(d, installEnd)
 }
 
 // logInstall installs one on-disk transaction from the disk log to the data
@@ -50,9 +70,18 @@ func installBlocks(d disk.Disk, bufs []Update) {
 // installEnd is the new last position installed to the data region (only used
 // for debugging)
 //
+// A failed install is retried up to installRetries times, with a growing
+// delay (from installBackoff) between attempts, and stops retrying once the log
+// is shut down; if it still fails, the log becomes read-only and nothing is
+// installed. The logged transactions
+// remain in the on-disk log, so recovery will install them.
+//
 // Installer holds memLock
 func (l *Walog) logInstall() (uint64, LogPosition) {
 	installEnd := l.st.diskEnd
+	if l.st.err != nil {
+		return 0, installEnd
+	}
 	bufs := l.st.memLog.takeTill(installEnd)
 	numBufs := uint64(len(bufs))
 	if numBufs == 0 {
@@ -62,12 +91,32 @@ func (l *Walog) logInstall() (uint64, LogPosition) {
 	l.memLock.Unlock()
 
 	util.DPrintf(5, "logInstall up to %d\n", installEnd)
-	installBlocks(l.d, bufs)
-	l.d.Barrier()
-	Advance(l.d, installEnd)
+	var err error
+	for i := 0; i < installRetries; i++ {
+		if i > 0 {
+			time.Sleep(installBackoff << (i - 1))
+			l.memLock.Lock()
+			shutdown := l.st.shutdown
+			l.memLock.Unlock()
+			if shutdown {
+				break
+			}
+		}
+		err = installTxn(l.d, bufs, installEnd)
+		if err == nil {
+			break
+		}
+		util.DPrintf(0, "logInstall: install up to %d failed (attempt %d): %v\n",
+			installEnd, i+1, err)
+	}
 
 	l.memLock.Lock()
+	if err != nil {
+		l.fail(fmt.Errorf("install: %w", err))
+		return 0, installEnd
+	}
 	l.st.cutMemLog(installEnd)
+	l.stats.InstalledBlocks.Add(numBufs)
 	l.condInstall.Broadcast()
 
 	return numBufs, installEnd
@@ -81,7 +130,9 @@ func (l *Walog) installer() {
 		blkcount, txn := l.logInstall()
 		if blkcount > 0 {
 			util.DPrintf(5, "Installed till txn %d\n", txn)
-		} else {
+		} else if !l.st.shutdown {
+			// logInstall may have released memLock, so Shutdown's
+			// broadcast could already have happened.
 			l.condInstall.Wait()
 		}
 	}
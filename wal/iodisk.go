@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/goose-lang/primitive/disk"
+)
+
+// ErrorDisk is a disk.Disk that can report I/O errors instead of panicking.
+//
+// When the log's disk is an ErrorDisk, the logger and installer use WriteErr
+// and BarrierErr, so that a failing device is reported rather than crashing
+// the program: a failed append switches the log to read-only (see
+// Walog.Err), and a failed install is retried a few times before doing the
+// same. Recovery and reads still use the plain disk.Disk methods.
+type ErrorDisk interface {
+	disk.Disk
+	// WriteErr is like Write, but returns an error if the write failed.
+	WriteErr(a uint64, v disk.Block) error
+	// BarrierErr is like Barrier, but returns an error if the writes before
+	// it could not be made durable.
+	BarrierErr() error
+}
+
+// ErrIO is wrapped by the error a log reports after its disk failed; the
+// log is then read-only.
+var ErrIO = errors.New("wal: I/O error, log is read-only")
+
+// installRetries is the number of attempts the installer makes at installing
+// a transaction before giving up
+const installRetries = 3
+
+// installBackoff is how long the installer waits before its first retry; it
+// doubles for each later retry
+const installBackoff = 10 * time.Millisecond
+
+func writeErr(d disk.Disk, a uint64, v disk.Block) error {
+	if ed, ok := d.(ErrorDisk); ok {
+		return ed.WriteErr(a, v)
+	}
+	d.Write(a, v)
+	return nil
+}
+
+func barrierErr(d disk.Disk) error {
+	if ed, ok := d.(ErrorDisk); ok {
+		return ed.BarrierErr()
+	}
+	d.Barrier()
+	return nil
+}
+
+// fail makes the log read-only after err, waking up every thread waiting on
+// the logger or installer so they can observe the failure.
+//
+// Assumes caller holds memLock.
+func (l *Walog) fail(err error) {
+	if l.st.err == nil {
+		l.st.err = fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	l.condLogger.Broadcast()
+	l.condInstall.Broadcast()
+}
+
+// Err returns the error that makes the log read-only, or nil if it is
+// writable: ErrReadOnly for a log opened with OpenLogReadOnly, or an error
+// wrapping ErrIO if the disk failed.
+func (l *Walog) Err() error {
+	l.memLock.Lock()
+	err := l.st.err
+	l.memLock.Unlock()
+	return err
+}
@@ -1,6 +1,8 @@
 package wal
 
 import (
+	"fmt"
+
 	"github.com/goose-lang/primitive"
 	"github.com/mit-pdos/go-journal/util"
 )
@@ -8,11 +10,14 @@ import (
 // Waits on the installer thread to free space in the log so everything
 // logged fits on disk.
 //
-// establishes uint64(len(l.memLog)) <= LOGSZ
+// establishes uint64(len(l.memLog)) <= l.LogSz()
 func (l *Walog) waitForSpace() {
 	// Wait until there is sufficient space on disk for the entire
 	// in-memory log (i.e., the installer must catch up).
-	for uint64(len(l.st.memLog.log)) > LOGSZ {
+	//
+	// Gives up if the installer stops because of shutdown or a disk error.
+	for uint64(len(l.st.memLog.log)) > l.LogSz() && !l.st.shutdown &&
+		l.st.err == nil {
 		l.condInstall.Wait()
 	}
 }
@@ -32,9 +37,12 @@ func (l *Walog) flushIfNeeded() {
 // assumes caller holds memLock
 //
 // Returns true if it made progress (for liveness, not important for
-// correctness).
+// correctness). If the append fails, the log becomes read-only.
 func (l *Walog) logAppend(circ *circularAppender) bool {
 	l.waitForSpace()
+	if l.st.shutdown || l.st.err != nil {
+		return false
+	}
 	l.flushIfNeeded()
 
 	diskEnd := l.st.diskEnd
@@ -44,12 +52,19 @@ func (l *Walog) logAppend(circ *circularAppender) bool {
 	}
 	l.memLock.Unlock()
 
-	circ.Append(l.d, diskEnd, newbufs)
+	err := circ.Append(l.d, diskEnd, newbufs)
 
 	l.memLock.Lock()
 
+	if err != nil {
+		util.DPrintf(0, "logAppend: append at %d failed: %v\n", diskEnd, err)
+		l.fail(fmt.Errorf("log append: %w", err))
+		return false
+	}
+
 	primitive.Linearize()
 
+	l.stats.LogBatch.Observe(uint64(len(newbufs)))
 	l.st.diskEnd = diskEnd + LogPosition(len(newbufs))
 	l.condLogger.Broadcast()
 	l.condInstall.Broadcast()
@@ -66,7 +81,9 @@ func (l *Walog) logger(circ *circularAppender) {
 	l.st.nthread += 1
 	for !l.st.shutdown {
 		progress := l.logAppend(circ)
-		if !progress {
+		if !progress && !l.st.shutdown {
+			// logAppend may have released memLock, so Shutdown's
+			// broadcast could already have happened.
 			l.condLogger.Wait()
 		}
 	}
@@ -0,0 +1,45 @@
+package wal
+
+import (
+	"github.com/mit-pdos/go-journal/stats"
+)
+
+// Stats are statistics about a Walog, updated as it runs.
+type Stats struct {
+	Appends      stats.Counter // successful MemAppend calls
+	AppendBlocks stats.Counter // blocks passed to successful MemAppend calls
+	// Absorbed counts appended blocks that replaced an earlier write to the
+	// same block still in memory, rather than taking up space in the log
+	Absorbed stats.Counter
+	// AppendWaits counts MemAppend calls that had to wait for the logger
+	// because the in-memory log was full
+	AppendWaits stats.Counter
+	// LogBatch is the number of blocks in each append to the on-disk log
+	// (the size of each group commit)
+	LogBatch        stats.Histogram
+	InstalledBlocks stats.Counter   // blocks installed to the data region
+	FlushLatency    stats.Histogram // time spent in Flush, in microseconds
+}
+
+// Stats returns the live statistics of l.
+func (l *Walog) Stats() *Stats {
+	return l.stats
+}
+
+// WriteMetrics writes s with metric names prefixed by go_journal_wal.
+func (s *Stats) WriteMetrics(w *stats.Writer) {
+	w.Counter("go_journal_wal_appends_total",
+		"Transactions appended to the in-memory log.", s.Appends.Load())
+	w.Counter("go_journal_wal_append_blocks_total",
+		"Blocks in transactions appended to the in-memory log.", s.AppendBlocks.Load())
+	w.Counter("go_journal_wal_absorbed_blocks_total",
+		"Appended blocks absorbed into an earlier write in memory.", s.Absorbed.Load())
+	w.Counter("go_journal_wal_append_waits_total",
+		"Appends that waited because the log was full.", s.AppendWaits.Load())
+	w.Histogram("go_journal_wal_log_batch_blocks",
+		"Blocks written by each append to the on-disk log.", &s.LogBatch, 1)
+	w.Counter("go_journal_wal_installed_blocks_total",
+		"Blocks installed to the data region.", s.InstalledBlocks.Load())
+	w.Histogram("go_journal_wal_flush_seconds",
+		"Time spent waiting for a transaction to become durable.", &s.FlushLatency, 1e-6)
+}
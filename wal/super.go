@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+)
+
+// SUPERMAGIC identifies a disk formatted with a journal ("gojrnl" in
+// little-endian ASCII).
+const SUPERMAGIC = uint64(0x6c6e726a6f67)
+
+// SUPERVERSION is the version of the on-disk format written by this package.
+// Recovery refuses to open other versions.
+const SUPERVERSION = uint64(1)
+
+var (
+	// ErrNotJournal is returned when the superblock does not describe a
+	// journal, for example because the disk holds something else.
+	ErrNotJournal = errors.New("wal: disk does not contain a journal")
+	// ErrVersion is returned when the journal was written in an unsupported
+	// format version.
+	ErrVersion = errors.New("wal: unsupported journal format version")
+)
+
+// Superblock describes the layout of a formatted journal disk.
+type Superblock struct {
+	Version   uint64
+	BlockSize uint64
+	LogStart  uint64 // first block of the log region
+	LogSz     uint64 // capacity of the log, in blocks
+	DataStart uint64 // first block after the journal
+}
+
+// mkSuperblock describes the layout of a journal with a log of capacity sz
+func mkSuperblock(sz uint64) Superblock {
+	return Superblock{
+		Version:   SUPERVERSION,
+		BlockSize: disk.BlockSize,
+		LogStart:  logStart(sz),
+		LogSz:     sz,
+		DataStart: LogDiskBlocks(sz),
+	}
+}
+
+func encodeSuper(s Superblock) disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(0) // checksum, filled in by sealHdr
+	enc.PutInt(SUPERMAGIC)
+	enc.PutInt(s.Version)
+	enc.PutInt(s.BlockSize)
+	enc.PutInt(s.LogStart)
+	enc.PutInt(s.LogSz)
+	enc.PutInt(s.DataStart)
+	return sealHdr(enc.Finish())
+}
+
+// decodeSuper decodes and validates a superblock read from d.
+func decodeSuper(d disk.Disk, super disk.Block) (Superblock, error) {
+	dec := marshal.NewDec(super)
+	_ = dec.GetInt() // checksum
+	magic := dec.GetInt()
+	if magic != SUPERMAGIC {
+		return Superblock{}, fmt.Errorf("%w: bad magic %#x", ErrNotJournal, magic)
+	}
+	if err := checkHdr(LOGSUPER, super); err != nil {
+		return Superblock{}, err
+	}
+	var s Superblock
+	s.Version = dec.GetInt()
+	s.BlockSize = dec.GetInt()
+	s.LogStart = dec.GetInt()
+	s.LogSz = dec.GetInt()
+	s.DataStart = dec.GetInt()
+	if s.Version != SUPERVERSION {
+		return s, fmt.Errorf("%w %d (expected %d)", ErrVersion,
+			s.Version, SUPERVERSION)
+	}
+	if s.BlockSize != disk.BlockSize {
+		return s, fmt.Errorf("%w: block size %d (expected %d)",
+			ErrCorruptHeader, s.BlockSize, disk.BlockSize)
+	}
+	if s.LogSz == 0 || s != mkSuperblock(s.LogSz) {
+		return s, fmt.Errorf("%w: inconsistent geometry %+v",
+			ErrCorruptHeader, s)
+	}
+	if s.DataStart > d.Size() {
+		return s, fmt.Errorf("%w: journal of %d blocks on a disk of %d blocks",
+			ErrCorruptHeader, s.DataStart, d.Size())
+	}
+	return s, nil
+}
+
+// ReadSuperblock reads and validates the superblock of a journal disk.
+//
+// Returns an error wrapping ErrNotJournal if the disk is not formatted, or
+// ErrVersion or ErrCorruptHeader if the superblock cannot be used.
+func ReadSuperblock(d disk.Disk) (Superblock, error) {
+	return decodeSuper(d, d.Read(LOGSUPER))
+}
+
+// FormatOpts configures Format.
+type FormatOpts struct {
+	// LogSz is the capacity of the log in blocks (0 means LOGSZ).
+	LogSz uint64
+}
+
+// Format writes a fresh, empty journal to d, discarding anything already
+// logged there. The data region (from LogDiskBlocks(opts.LogSz) on) is not
+// modified.
+func Format(d disk.Disk, opts FormatOpts) error {
+	var sz = opts.LogSz
+	if sz == 0 {
+		sz = LOGSZ
+	}
+	if LogDiskBlocks(sz) > d.Size() {
+		return fmt.Errorf("wal: log of %d blocks does not fit on a disk of %d blocks",
+			sz, d.Size())
+	}
+	initCircular(d, sz)
+	return nil
+}
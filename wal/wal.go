@@ -1,7 +1,10 @@
 package wal
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/goose-lang/primitive"
 
@@ -11,8 +14,17 @@ import (
 	"github.com/mit-pdos/go-journal/util"
 )
 
-func mkLog(disk disk.Disk) *Walog {
-	circ, start, end, memLog := recoverCircular(disk)
+func mkLog(disk disk.Disk, logSz uint64) (*Walog, error) {
+	return recoverLog(disk, logSz, false)
+}
+
+// recoverLog recovers the log on disk into memory (see recoverCircular),
+// without starting the logger and installer.
+func recoverLog(disk disk.Disk, logSz uint64, readOnly bool) (*Walog, error) {
+	circ, start, end, memLog, err := recoverCircular(disk, logSz, readOnly)
+	if err != nil {
+		return nil, err
+	}
 	ml := new(sync.Mutex)
 	st := &WalogState{
 		memLog:   mkSliding(memLog, start),
@@ -28,9 +40,10 @@ func mkLog(disk disk.Disk) *Walog {
 		condLogger:  sync.NewCond(ml),
 		condInstall: sync.NewCond(ml),
 		condShut:    sync.NewCond(ml),
+		stats:       new(Stats),
 	}
-	util.DPrintf(1, "mkLog: size %d\n", LOGSZ)
-	return l
+	util.DPrintf(1, "mkLog: size %d\n", circ.sz)
+	return l, nil
 }
 
 func (l *Walog) startBackgroundThreads() {
@@ -38,12 +51,51 @@ func (l *Walog) startBackgroundThreads() {
 	go func() { l.installer() }()
 }
 
-func MkLog(disk disk.Disk) *Walog {
-	l := mkLog(disk)
+// OpenLog recovers the write-ahead log on disk and starts the logger and
+// installer.
+//
+// If the disk has no log yet (it is all zero), OpenLog formats a log with
+// capacity logSz blocks, which then occupies the first LogDiskBlocks(logSz)
+// blocks of the disk (see also Format). An existing log keeps the capacity
+// recorded in its superblock and logSz is ignored.
+//
+// Returns an error wrapping ErrNotJournal if the disk holds something other
+// than a journal, ErrVersion if the journal uses a different format version,
+// and ErrCorruptHeader if the on-disk log headers are damaged.
+func OpenLog(disk disk.Disk, logSz uint64) (*Walog, error) {
+	l, err := mkLog(disk, logSz)
+	if err != nil {
+		return nil, err
+	}
 	l.startBackgroundThreads()
+	return l, nil
+}
+
+// MkLog is like OpenLog, but panics if the log cannot be recovered.
+func MkLog(disk disk.Disk, logSz uint64) *Walog {
+	l, err := OpenLog(disk, logSz)
+	if err != nil {
+		panic(err)
+	}
 	return l
 }
 
+// OpenLogReadOnly recovers the write-ahead log on disk into memory only, for
+// inspecting a disk without modifying it.
+//
+// Reads see the recovered state, with logged transactions applied, but
+// nothing is ever written to disk: no logger or installer runs, appends fail
+// with ErrReadOnly, and a disk without a journal is reported as ErrNotJournal
+// rather than formatted.
+func OpenLogReadOnly(disk disk.Disk) (*Walog, error) {
+	l, err := recoverLog(disk, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	l.st.err = ErrReadOnly
+	return l, nil
+}
+
 // Assumes caller holds memLock
 func doMemAppend(memLog *sliding, bufs []Update) LogPosition {
 	memLog.memWrite(bufs)
@@ -113,39 +165,84 @@ func (st *WalogState) updatesOverflowU64(newUpdates uint64) bool {
 }
 
 // TODO: relate this calculation to the circular log free space
-func (st *WalogState) memLogHasSpace(newUpdates uint64) bool {
+func (st *WalogState) memLogHasSpace(logSz uint64, newUpdates uint64) bool {
 	memSize := uint64(st.memEnd() - st.diskEnd)
-	if memSize+newUpdates > LOGSZ {
+	if memSize+newUpdates > logSz {
 		return false
 	}
 	return true
 }
 
+// Errors returned by MemAppendErr.
+var (
+	// ErrTxnTooLarge is returned for an append of more blocks than the log
+	// can hold.
+	ErrTxnTooLarge = errors.New("wal: transaction larger than the log")
+	// ErrOverflow is returned when an append would overflow the 64-bit log
+	// position.
+	ErrOverflow = errors.New("wal: log position overflow")
+	// ErrLogShutdown is returned for an append after Shutdown.
+	ErrLogShutdown = errors.New("wal: log is shut down")
+	// ErrReadOnly is returned for an append to a log opened with
+	// OpenLogReadOnly.
+	ErrReadOnly = errors.New("wal: log is opened read-only")
+)
+
 // Append to in-memory log.
 //
 // On success returns the pos for this append.
 //
-// On failure guaranteed to be idempotent (failure can only occur in principle,
-// due overflowing 2^64 writes)
+// On failure guaranteed to be idempotent. An append fails if bufs do not fit
+// in the log, if the log position would overflow 2^64 writes, or if the log is
+// shut down, read-only, or failed after a disk error; MemAppendErr reports
+// which.
 func (l *Walog) MemAppend(bufs []Update) (LogPosition, bool) {
-	if uint64(len(bufs)) > LOGSZ {
-		return 0, false
+	txn, err := l.MemAppendErr(bufs)
+	return txn, err == nil
+}
+
+// MemAppendErr is like MemAppend, but reports why an append failed:
+// ErrTxnTooLarge if bufs cannot fit in the log, ErrOverflow if the log
+// position would overflow, ErrLogShutdown if the log has been shut down,
+// ErrReadOnly if it was opened read-only, or an error wrapping ErrIO if the
+// disk failed.
+func (l *Walog) MemAppendErr(bufs []Update) (LogPosition, error) {
+	if uint64(len(bufs)) > l.LogSz() {
+		return 0, fmt.Errorf("%w: %d blocks in a log of %d", ErrTxnTooLarge,
+			len(bufs), l.LogSz())
 	}
 
 	var txn LogPosition = 0
-	var ok = true
+	var err error = nil
+	var waited = false
 	l.memLock.Lock()
 	st := l.st
 	for {
+		if st.shutdown {
+			err = ErrLogShutdown
+			break
+		}
+		if st.err != nil {
+			err = st.err
+			break
+		}
 		if st.updatesOverflowU64(uint64(len(bufs))) {
-			ok = false
+			err = ErrOverflow
 			break
 		}
-		if st.memLogHasSpace(uint64(len(bufs))) {
+		if st.memLogHasSpace(l.LogSz(), uint64(len(bufs))) {
+			oldEnd := st.memEnd()
 			txn = doMemAppend(st.memLog, bufs)
 			primitive.Linearize()
+			l.stats.Appends.Inc()
+			l.stats.AppendBlocks.Add(uint64(len(bufs)))
+			l.stats.Absorbed.Add(uint64(len(bufs)) - uint64(txn-oldEnd))
 			break
 		}
+		if !waited {
+			waited = true
+			l.stats.AppendWaits.Inc()
+		}
 		util.DPrintf(5, "memAppend: log is full; try again")
 		// commit everything, stable and unstable trans
 		st.endGroupTxn()
@@ -154,14 +251,33 @@ func (l *Walog) MemAppend(bufs []Update) (LogPosition, bool) {
 		continue
 	}
 	l.memLock.Unlock()
-	return txn, ok
+	return txn, err
 }
 
 // Flush flushes a transaction pos (and all preceding transactions)
 //
 // The implementation waits until the logger has appended in-memory log up to
 // txn to on-disk log.
+//
+// If the disk fails or the log is shut down before pos is durable, Flush
+// returns without waiting further; use FlushErr to find out whether pos is
+// durable.
 func (l *Walog) Flush(pos LogPosition) {
+	_ = l.FlushErr(pos)
+}
+
+// FlushErr is like Flush, but returns an error wrapping ErrIO if the disk
+// fails before pos is durable, in which case pos (and any later transactions)
+// will never become durable. Flushing a transaction that was not logged before
+// Shutdown fails with ErrLogShutdown.
+func (l *Walog) FlushErr(pos LogPosition) error {
+	start := time.Now()
+	err := l.flush(pos)
+	l.stats.FlushLatency.ObserveSince(start)
+	return err
+}
+
+func (l *Walog) flush(pos LogPosition) error {
 	util.DPrintf(2, "Flush: commit till txn %d\n", pos)
 	l.memLock.Lock()
 	l.condLogger.Broadcast()
@@ -174,12 +290,65 @@ func (l *Walog) Flush(pos LogPosition) {
 		l.st.endGroupTxn()
 	}
 	for !(pos <= l.st.diskEnd) {
+		if l.st.err != nil {
+			err := l.st.err
+			l.memLock.Unlock()
+			return err
+		}
+		if l.st.shutdown {
+			l.memLock.Unlock()
+			return ErrLogShutdown
+		}
 		l.condLogger.Wait()
 	}
 	primitive.Linearize()
 	// establishes pos <= l.st.diskEnd
 	// (pos is now durably on disk)
 	l.memLock.Unlock()
+	return nil
+}
+
+// Checkpoint makes every transaction appended so far durable, then waits for
+// the installer to install all of them to their home locations and advance
+// the start of the on-disk log past them, so that the data region alone is a
+// consistent image (until the next append).
+//
+// Returns the error from FlushErr if the transactions cannot be made durable,
+// ErrLogShutdown if the log is shut down first, or the error that made the log
+// read-only (see Err) if they cannot be installed.
+func (l *Walog) Checkpoint() error {
+	l.memLock.Lock()
+	pos := l.st.memEnd()
+	l.memLock.Unlock()
+
+	if err := l.FlushErr(pos); err != nil {
+		return err
+	}
+
+	l.memLock.Lock()
+	var err error = nil
+	for l.st.memLog.start < pos {
+		if l.st.err != nil {
+			err = l.st.err
+			break
+		}
+		if l.st.shutdown {
+			err = ErrLogShutdown
+			break
+		}
+		l.condInstall.Wait()
+	}
+	l.memLock.Unlock()
+	return err
+}
+
+// IsDurable reports whether the transaction ending at pos (and all preceding
+// transactions) has been appended to the on-disk log, without waiting.
+func (l *Walog) IsDurable(pos LogPosition) bool {
+	l.memLock.Lock()
+	durable := pos <= l.st.diskEnd
+	l.memLock.Unlock()
+	return durable
 }
 
 // Shutdown logger and installer
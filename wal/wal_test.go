@@ -1,8 +1,11 @@
 package wal
 
 import (
+	"errors"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/goose-lang/primitive/disk"
 	"github.com/stretchr/testify/assert"
@@ -60,7 +63,9 @@ func (l logWrapper) installOnce() {
 func (l *logWrapper) Restart() {
 	l.Walog.Shutdown()
 	d := l.Walog.d
-	l.Walog = mkLog(d)
+	var err error
+	l.Walog, err = mkLog(d, LOGSZ)
+	l.assert.NoError(err, "recovery failed")
 }
 
 type WalSuite struct {
@@ -71,7 +76,9 @@ type WalSuite struct {
 
 func (suite *WalSuite) SetupTest() {
 	suite.d = disk.NewMemDisk(10000)
-	suite.l = logWrapper{assert: suite.Assert(), Walog: mkLog(suite.d)}
+	l, err := mkLog(suite.d, LOGSZ)
+	suite.Require().NoError(err)
+	suite.l = logWrapper{assert: suite.Assert(), Walog: l}
 }
 
 func TestWal(t *testing.T) {
@@ -251,6 +258,16 @@ func (suite *WalSuite) TestShutdownInProgress() {
 	l.Shutdown()
 }
 
+func (suite *WalSuite) TestFlushAfterShutdown() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	l.Shutdown()
+	// the logger never ran, so pos cannot become durable
+	suite.True(errors.Is(l.FlushErr(pos), ErrLogShutdown))
+	l.Flush(pos)
+	suite.False(l.IsDurable(pos))
+}
+
 func (suite *WalSuite) TestRecoverFlushed() {
 	l := suite.l
 	l.startBackgroundThreads()
@@ -304,3 +321,553 @@ func (suite *WalSuite) TestRecoverUninstalled() {
 	suite.Equal(block1, l.Read(1), "installed txn")
 	suite.Equal(block2, l.Read(1+LOGSZ), "logged but uninstalled txn")
 }
+
+// corruptBlock flips a byte in block bn directly on disk
+func corruptBlock(d disk.Disk, bn common.Bnum) {
+	b := d.Read(bn)
+	b[100] ^= 0xff
+	d.Write(bn, b)
+}
+
+func (suite *WalSuite) TestRecoverTornAppend() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	pos = l.MemAppend(contiguousTxn(20, 3, block2))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+
+	// the second append went to log positions [3, 6)
+	corruptBlock(suite.d, logStart(LOGSZ)+4)
+	l.Restart()
+	suite.Equal(block1, l.Read(1), "first txn is intact")
+	suite.Equal(block0, l.Read(20), "torn txn should not be replayed")
+	suite.Equal(block0, l.Read(22), "torn txn should not be replayed")
+}
+
+func (suite *WalSuite) TestRecoverTornAppendThenCrash() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	pos = l.MemAppend(contiguousTxn(20, 3, block2))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+
+	// tear the middle of the second append, at log positions [3, 6)
+	corruptBlock(suite.d, logStart(LOGSZ)+4)
+	l.Restart()
+	suite.Equal(uint64(3), decodeHdr1(suite.d.Read(LOGHDR)),
+		"recovery should make the truncation durable")
+
+	// crash while appending a new txn over [3, 5), before its end header;
+	// position 5 still holds the valid last block of the torn append
+	bufs := contiguousTxn(30, 2, block1)
+	suite.Require().NoError(l.circ.logBlocks(suite.d, 3, bufs))
+	suite.Require().NoError(l.circ.logAddrs(suite.d, 3, 5))
+	l.Restart()
+	suite.Equal(block1, l.Read(1), "first txn is intact")
+	suite.Equal(block0, l.Read(30), "uncommitted txn should not be replayed")
+	suite.Equal(block0, l.Read(22), "torn txn should not be replayed")
+}
+
+func (suite *WalSuite) TestRecoverTornAddrBlock() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	pos = l.MemAppend(contiguousTxn(20, 3, block2))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	l.Shutdown()
+
+	// simulate a crash while logging the second txn: its address block
+	// write is torn and the end header was never written
+	Truncate(suite.d, 3)
+	_, gen := readAddrBlock(suite.d, 0)
+	corruptBlock(suite.d, addrCopy(0, gen))
+	l.Restart()
+	suite.Equal(block1, l.Read(1), "committed txn survives the torn write")
+	suite.Equal(block1, l.Read(3), "committed txn survives the torn write")
+	suite.Equal(block0, l.Read(20))
+}
+
+func (suite *WalSuite) TestRecoverCorruptFirstBlock() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+
+	corruptBlock(suite.d, logStart(LOGSZ))
+	l.Restart()
+	suite.Equal(block0, l.Read(1))
+	suite.Equal(block0, l.Read(3), "txn should not be partially replayed")
+}
+
+func (suite *WalSuite) TestRecoverCorruptHeader() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	l.Shutdown()
+
+	corruptBlock(suite.d, LOGHDR)
+	_, err := mkLog(suite.d, LOGSZ)
+	suite.True(errors.Is(err, ErrCorruptHeader),
+		"expected corrupt header error, got %v", err)
+
+	hdr2 := suite.d.Read(LOGHDR2)
+	hdr2[0] ^= 0xff
+	suite.d.Write(LOGHDR2, hdr2)
+	_, err = mkLog(suite.d, LOGSZ)
+	suite.True(errors.Is(err, ErrCorruptHeader))
+}
+
+func (suite *WalSuite) TestRecoverCorruptChecksumField() {
+	suite.l.Shutdown()
+	// the checksum field is 8 bytes, all of which must match
+	hdr := suite.d.Read(LOGHDR)
+	hdr[5] ^= 0xff
+	suite.d.Write(LOGHDR, hdr)
+	_, err := mkLog(suite.d, LOGSZ)
+	suite.True(errors.Is(err, ErrCorruptHeader),
+		"expected corrupt header error, got %v", err)
+}
+
+func (suite *WalSuite) TestDefaultLayout() {
+	suite.Equal(uint64(511), LOGSZ,
+		"default capacity should match the original header-only format")
+	suite.Equal(LOGDISKBLOCKS, LogDiskBlocks(LOGSZ))
+	suite.Equal(uint64(520), LOGDISKBLOCKS)
+	suite.Equal(LOGSZ, suite.l.LogSz())
+	s, err := decodeSuper(suite.d, suite.d.Read(LOGSUPER))
+	suite.Require().NoError(err)
+	suite.Equal(LOGDISKBLOCKS, s.DataStart, "superblock records the data region")
+}
+
+func TestLargeLog(t *testing.T) {
+	assert := assert.New(t)
+	const logSz = 2000
+	d := disk.NewMemDisk(10000)
+	l, err := OpenLog(d, logSz)
+	assert.NoError(err)
+	assert.Equal(uint64(logSz), l.LogSz())
+	start := LogDiskBlocks(logSz)
+	var txn []Update
+	for i := uint64(0); i < logSz; i++ {
+		txn = append(txn, MkBlockData(start+i, mkBlock(byte(i))))
+	}
+	pos, ok := l.MemAppend(txn)
+	assert.True(ok, "transaction should fit in large log")
+	l.Flush(pos)
+	l.Shutdown()
+
+	// the size passed here only applies to an unformatted disk
+	l, err = OpenLog(d, LOGSZ)
+	assert.NoError(err)
+	assert.Equal(uint64(logSz), l.LogSz(), "log size should be persistent")
+	for i := uint64(0); i < logSz; i++ {
+		assert.Equal(mkBlock(byte(i)), l.Read(start+i))
+	}
+	_, ok = l.MemAppend(append(txn, MkBlockData(start+logSz, block1)))
+	assert.False(ok, "transaction larger than the log should fail")
+	l.Shutdown()
+}
+
+func TestLogTooLarge(t *testing.T) {
+	d := disk.NewMemDisk(100)
+	_, err := OpenLog(d, 100)
+	assert.Error(t, err)
+}
+
+func (suite *WalSuite) TestInitCircular() {
+	suite.l.Shutdown()
+	d := disk.NewMemDisk(10000)
+	initCircular(d, 10)
+	l, err := mkLog(d, LOGSZ)
+	suite.Require().NoError(err)
+	suite.Equal(LogPosition(0), l.st.diskEnd)
+	suite.Equal(uint64(10), l.LogSz())
+}
+
+func TestSuperblock(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	_, err := ReadSuperblock(d)
+	assert.True(errors.Is(err, ErrNotJournal), "unformatted disk")
+
+	assert.NoError(Format(d, FormatOpts{LogSz: 1000}))
+	s, err := ReadSuperblock(d)
+	assert.NoError(err)
+	assert.Equal(Superblock{
+		Version:   SUPERVERSION,
+		BlockSize: disk.BlockSize,
+		LogStart:  logStart(1000),
+		LogSz:     1000,
+		DataStart: LogDiskBlocks(1000),
+	}, s)
+
+	l, err := OpenLog(d, LOGSZ)
+	assert.NoError(err)
+	assert.Equal(uint64(1000), l.LogSz(), "Format should set the log size")
+	l.Shutdown()
+}
+
+func TestFormatDiscardsLog(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	l, err := OpenLog(d, LOGSZ)
+	assert.NoError(err)
+	pos, _ := l.MemAppend(contiguousTxn(LOGDISKBLOCKS, 3, block1))
+	l.Flush(pos)
+	l.Shutdown()
+
+	assert.NoError(Format(d, FormatOpts{}))
+	l, err = mkLog(d, LOGSZ)
+	assert.NoError(err)
+	assert.Equal(LogPosition(0), l.st.diskEnd, "log should be empty")
+	assert.Error(Format(disk.NewMemDisk(100), FormatOpts{}),
+		"log should not fit")
+}
+
+func TestNotJournal(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	d.Write(LOGSUPER, mkBlock(1))
+	_, err := OpenLog(d, LOGSZ)
+	assert.True(errors.Is(err, ErrNotJournal), "got %v", err)
+
+	d = disk.NewMemDisk(10000)
+	d.Write(LOGHDR2, mkBlock(1))
+	_, err = OpenLog(d, LOGSZ)
+	assert.True(errors.Is(err, ErrNotJournal),
+		"disk with a zero first block is not necessarily empty")
+}
+
+func TestSuperblockVersion(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	assert.NoError(Format(d, FormatOpts{}))
+	s := mkSuperblock(LOGSZ)
+	s.Version = SUPERVERSION + 1
+	d.Write(LOGSUPER, encodeSuper(s))
+	_, err := OpenLog(d, LOGSZ)
+	assert.True(errors.Is(err, ErrVersion), "got %v", err)
+
+	s = mkSuperblock(LOGSZ)
+	s.DataStart += 1
+	d.Write(LOGSUPER, encodeSuper(s))
+	_, err = OpenLog(d, LOGSZ)
+	assert.True(errors.Is(err, ErrCorruptHeader), "got %v", err)
+}
+
+func (suite *WalSuite) TestInspect() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	pos = l.MemAppend(contiguousTxn(20, 3, block2))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	corruptBlock(suite.d, logStart(LOGSZ)+4)
+
+	info, err := Inspect(suite.d)
+	suite.Require().NoError(err)
+	suite.NoError(info.HdrErr)
+	suite.Equal(LogPosition(0), info.Start)
+	suite.Equal(LogPosition(6), info.End)
+	suite.Equal(LogPosition(3), info.ValidEnd, "torn txn should be truncated")
+	suite.Require().Len(info.Entries, 6)
+	for i, e := range info.Entries {
+		suite.Equal(LogPosition(i), e.Pos)
+		suite.Equal(logStart(LOGSZ)+uint64(i), e.LogBlock)
+		suite.Equal(i != 4, e.ChecksumOK, "pos %d", i)
+		suite.Equal(i < 3, e.Replayed, "pos %d", i)
+		suite.Equal(i == 2 || i == 5, e.Last, "pos %d", i)
+	}
+	suite.Equal(dataBnum(1), info.Entries[0].Addr)
+	suite.Equal(dataBnum(21), info.Entries[4].Addr)
+
+	corruptBlock(suite.d, LOGHDR)
+	info, err = Inspect(suite.d)
+	suite.Require().NoError(err)
+	suite.True(errors.Is(info.HdrErr, ErrCorruptHeader))
+	for _, e := range info.Entries {
+		suite.False(e.Replayed, "nothing is replayed with a corrupt header")
+	}
+
+	_, err = Inspect(disk.NewMemDisk(100))
+	suite.True(errors.Is(err, ErrNotJournal))
+}
+
+var errInjected = errors.New("injected I/O error")
+
+// faultyDisk is an ErrorDisk whose writes fail while fail returns true
+type faultyDisk struct {
+	disk.Disk
+	mu   sync.Mutex
+	fail func(a uint64) bool
+}
+
+func (d *faultyDisk) setFail(fail func(a uint64) bool) {
+	d.mu.Lock()
+	d.fail = fail
+	d.mu.Unlock()
+}
+
+func (d *faultyDisk) WriteErr(a uint64, v disk.Block) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fail != nil && d.fail(a) {
+		return errInjected
+	}
+	d.Disk.Write(a, v)
+	return nil
+}
+
+func (d *faultyDisk) BarrierErr() error {
+	d.Disk.Barrier()
+	return nil
+}
+
+func mustAppend(t *testing.T, l *Walog, bufs []Update) LogPosition {
+	pos, err := l.MemAppendErr(bufs)
+	assert.NoError(t, err)
+	return pos
+}
+
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal(msg)
+}
+
+func TestAppendError(t *testing.T) {
+	assert := assert.New(t)
+	mem := disk.NewMemDisk(10000)
+	d := &faultyDisk{Disk: mem}
+	l, err := OpenLog(d, LOGSZ)
+	assert.NoError(err)
+	l.Flush(mustAppend(t, l, contiguousTxn(1, 3, block1)))
+
+	d.setFail(func(a uint64) bool { return a < LOGDISKBLOCKS })
+	pos := mustAppend(t, l, contiguousTxn(20, 3, block2))
+	err = l.FlushErr(pos)
+	assert.True(errors.Is(err, ErrIO), "got %v", err)
+	assert.True(errors.Is(err, errInjected), "got %v", err)
+	l.Flush(pos) // returns rather than waiting forever
+	assert.True(errors.Is(l.Err(), ErrIO))
+	_, err = l.MemAppendErr(contiguousTxn(30, 1, block2))
+	assert.True(errors.Is(err, ErrIO), "log should be read-only")
+	assert.Equal(block2, l.Read(dataBnum(20)), "reads still work")
+	l.Shutdown()
+
+	l, err = OpenLog(mem, LOGSZ)
+	assert.NoError(err)
+	assert.Equal(block1, l.Read(dataBnum(1)))
+	assert.Equal(block0, l.Read(dataBnum(20)), "failed append is not durable")
+	l.Shutdown()
+}
+
+func TestInstallError(t *testing.T) {
+	assert := assert.New(t)
+	mem := disk.NewMemDisk(10000)
+	d := &faultyDisk{Disk: mem}
+	l, err := OpenLog(d, LOGSZ)
+	assert.NoError(err)
+
+	// transient errors are retried
+	var failures = 0
+	d.setFail(func(a uint64) bool {
+		if a >= LOGDISKBLOCKS && failures < installRetries-1 {
+			failures++
+			return true
+		}
+		return false
+	})
+	l.Flush(mustAppend(t, l, contiguousTxn(1, 3, block1)))
+	waitFor(t, func() bool {
+		return reflect.DeepEqual(mem.Read(dataBnum(1)), block1)
+	}, "transaction should be installed after retrying")
+	assert.NoError(l.Err())
+
+	// persistent errors make the log read-only
+	d.setFail(func(a uint64) bool { return a >= LOGDISKBLOCKS })
+	l.Flush(mustAppend(t, l, contiguousTxn(20, 3, block2)))
+	waitFor(t, func() bool { return l.Err() != nil },
+		"install failure should be reported")
+	assert.True(errors.Is(l.Err(), errInjected))
+	_, err = l.MemAppendErr(contiguousTxn(30, 1, block2))
+	assert.True(errors.Is(err, ErrIO))
+	l.Shutdown()
+
+	l, err = OpenLog(mem, LOGSZ)
+	assert.NoError(err)
+	assert.Equal(block2, l.Read(dataBnum(20)), "logged transaction is recovered")
+	l.Shutdown()
+}
+
+// noWriteDisk panics on any write
+type noWriteDisk struct {
+	disk.Disk
+}
+
+func (d noWriteDisk) Write(a uint64, v disk.Block) {
+	panic("write to read-only disk")
+}
+
+func (suite *WalSuite) TestOpenReadOnly() {
+	l := suite.l
+	pos := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	l.Shutdown()
+
+	ro, err := OpenLogReadOnly(noWriteDisk{suite.d})
+	suite.Require().NoError(err)
+	suite.Equal(block1, ro.Read(dataBnum(2)), "logged txn should be visible")
+	suite.Equal(block0, suite.d.Read(dataBnum(2)), "but not installed")
+	_, err = ro.MemAppendErr(contiguousTxn(20, 1, block2))
+	suite.True(errors.Is(err, ErrReadOnly), "got %v", err)
+	suite.Equal(ErrReadOnly, ro.Err())
+	ro.Flush(pos)
+	ro.Shutdown()
+
+	_, err = OpenLogReadOnly(noWriteDisk{disk.NewMemDisk(1000)})
+	suite.True(errors.Is(err, ErrNotJournal), "read-only open should not format")
+}
+
+func (suite *WalSuite) TestCheckpoint() {
+	l := suite.l
+	l.startBackgroundThreads()
+	l.MemAppend(contiguousTxn(1, 3, block1))
+	l.MemAppend(contiguousTxn(20, 10, block2))
+	suite.Require().NoError(l.Checkpoint())
+
+	suite.Equal(block1, suite.d.Read(dataBnum(3)), "should be installed")
+	suite.Equal(block2, suite.d.Read(dataBnum(29)), "should be installed")
+	info, err := Inspect(suite.d)
+	suite.Require().NoError(err)
+	suite.Equal(info.Start, info.End, "on-disk log should be empty")
+	suite.NoError(l.Checkpoint(), "empty checkpoint")
+
+	l.Shutdown()
+}
+
+func TestCheckpointReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	d := disk.NewMemDisk(10000)
+	l, err := mkLog(d, LOGSZ)
+	assert.NoError(err)
+	pos, _ := l.MemAppend(contiguousTxn(1, 3, block1))
+	go func() { l.logger(l.circ) }()
+	l.Flush(pos)
+	l.Shutdown()
+
+	ro, err := OpenLogReadOnly(d)
+	assert.NoError(err)
+	assert.Equal(ErrReadOnly, ro.Checkpoint(), "logged txn cannot be installed")
+}
+
+func (suite *WalSuite) TestStats() {
+	l := suite.l
+	l.MemAppend(contiguousTxn(1, 3, block1))
+	pos := l.MemAppend(contiguousTxn(2, 3, block2))
+	go func() {
+		l.Flush(pos)
+	}()
+	l.logOnce()
+	s := l.Stats()
+	suite.Equal(uint64(2), s.Appends.Load())
+	suite.Equal(uint64(6), s.AppendBlocks.Load())
+	suite.Equal(uint64(2), s.Absorbed.Load(), "blocks 2 and 3 are absorbed")
+	suite.Equal(uint64(4), s.LogBatch.Snapshot().Sum)
+	l.install()
+	suite.Equal(uint64(4), s.InstalledBlocks.Load())
+}
+
+// shutdownDuringFailure calls Shutdown while a write to a failing address is
+// in progress, and checks that Shutdown still returns.
+func shutdownDuringFailure(t *testing.T, l *Walog, d *faultyDisk,
+	failing func(a uint64) bool, start func()) {
+	inIO := make(chan struct{})
+	resume := make(chan struct{})
+	var once sync.Once
+	d.setFail(func(a uint64) bool {
+		if !failing(a) {
+			return false
+		}
+		once.Do(func() {
+			close(inIO)
+			<-resume
+		})
+		return true
+	})
+	start()
+	<-inIO
+
+	done := make(chan struct{})
+	go func() {
+		l.Shutdown()
+		close(done)
+	}()
+	waitFor(t, func() bool {
+		l.memLock.Lock()
+		defer l.memLock.Unlock()
+		return l.st.shutdown
+	}, "Shutdown should start")
+	close(resume)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown hung behind a failed write")
+	}
+}
+
+func TestShutdownDuringFailedInstall(t *testing.T) {
+	d := &faultyDisk{Disk: disk.NewMemDisk(10000)}
+	l, err := OpenLog(d, LOGSZ)
+	assert.NoError(t, err)
+	shutdownDuringFailure(t, l, d,
+		func(a uint64) bool { return a >= LOGDISKBLOCKS },
+		func() { l.Flush(mustAppend(t, l, contiguousTxn(1, 3, block1))) })
+}
+
+func TestShutdownDuringFailedAppend(t *testing.T) {
+	d := &faultyDisk{Disk: disk.NewMemDisk(10000)}
+	l, err := OpenLog(d, LOGSZ)
+	assert.NoError(t, err)
+	shutdownDuringFailure(t, l, d,
+		func(a uint64) bool { return a < LOGDISKBLOCKS },
+		func() {
+			pos := mustAppend(t, l, contiguousTxn(1, 3, block1))
+			go l.Flush(pos)
+		})
+}